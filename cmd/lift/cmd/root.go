@@ -1,9 +1,15 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/bjwschaap/alpine-lift/pkg/lift"
 	homedir "github.com/mitchellh/go-homedir"
@@ -12,6 +18,9 @@ import (
 	"github.com/spf13/viper"
 )
 
+// exit code used when lift was interrupted by a signal (128 + SIGINT)
+const exitInterrupted = 130
+
 var (
 	// RootCmd represents the base command when called without any subcommands
 	RootCmd = &cobra.Command{
@@ -20,45 +29,45 @@ var (
 		Short:   "A cloud-init alternative for Alpine Linux",
 		Long:    `Lift performs initial OS configuration on first boot.`,
 		Run: func(cmd *cobra.Command, args []string) {
-
-			if viper.GetBool("debug") {
-				log.SetLevel(log.DebugLevel)
-			}
-
-			if viper.GetBool("no-color") {
-				logFormat = log.TextFormatter{
-					ForceColors:     false,
-					DisableColors:   true,
-					FullTimestamp:   true,
-					TimestampFormat: "2006-01-02T15:04:05.999999999",
-				}
-			}
-
-			if viper.GetBool("json") {
-				log.SetFormatter(&log.JSONFormatter{})
-			}
-
-			headers := make(map[string][]string)
-			for _, h := range viper.GetStringSlice("request-headers") {
-				words := strings.SplitN(h, ":", 2)
-				key := strings.TrimSpace(words[0])
-				value := strings.TrimSpace(words[1])
-				if key == "" || value == "" {
-					log.Errorf("Invalid request header: %s", h)
-					log.Error("Lift aborted")
-					os.Exit(1)
-				}
-				headers[key] = append(headers[key], value)
-			}
-
-			lift, err := lift.New(viper.GetString("alpine-data-url"), headers)
+			setupLogging()
+
+			lift, err := lift.New(viper.GetString("alpine-data-url"), requestHeaders(),
+				lift.WithSilent(viper.GetBool("silent")),
+				lift.WithOffline(viper.GetBool("offline")),
+				lift.WithDryRun(viper.GetBool("dry-run")),
+				lift.WithStatusFile(viper.GetString("status-file")),
+				lift.WithMetricsURL(viper.GetString("metrics-url")),
+				lift.WithStatusServer(statusAddr()),
+				lift.WithBuildInfo(lift.BuildInfo{Version: version, Commit: gitTag, BuildDate: buildDate}),
+				lift.WithConfirm(confirmFunc()),
+				lift.WithRescue(viper.GetBool("rescue")),
+			)
 			if err != nil {
 				log.Error(err)
 				log.Error("Lift aborted")
 				os.Exit(1)
 			}
 
-			if err = lift.Start(); err != nil {
+			// Interrupt the running stage on SIGINT/SIGTERM, so lift can clean up
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				if s, ok := <-sigs; ok {
+					log.Warnf("Received %s, interrupting lift", s)
+					cancel()
+				}
+			}()
+
+			err = lift.Run(ctx)
+			signal.Stop(sigs)
+			close(sigs)
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Error("Lift interrupted")
+					os.Exit(exitInterrupted)
+				}
 				log.Error(err)
 				log.Error("Lift aborted")
 				os.Exit(1)
@@ -79,6 +88,15 @@ var (
 	debug   bool
 	json    bool
 	nocolor bool
+	silent  bool
+	offline bool
+	dryRun  bool
+	status  string
+	metrics string
+	port    int
+	bind    string
+	confirm bool
+	rescue  bool
 )
 
 func init() {
@@ -93,13 +111,98 @@ func init() {
 	RootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "enable debug logging")
 	RootCmd.PersistentFlags().BoolVar(&nocolor, "no-color", false, "disable colors in logging")
 	RootCmd.PersistentFlags().BoolVarP(&json, "json", "j", false, "Log output in JSON format")
+	RootCmd.PersistentFlags().BoolVar(&silent, "silent", false, "silence all logging and output")
+	RootCmd.PersistentFlags().BoolVar(&offline, "offline", false, "disable all network downloads (air-gapped mode)")
+	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "log the commands instead of running them, and write files to a temporary directory")
 	RootCmd.PersistentFlags().StringVarP(&dataURL, "alpine-data-url", "s", "", "URL to download alpine-data")
+	RootCmd.PersistentFlags().StringVar(&status, "status-file", "", "write lift status (JSON) to this file")
+	RootCmd.PersistentFlags().StringVar(&metrics, "metrics-url", "", "URL to POST the final lift status (JSON) to")
+	RootCmd.PersistentFlags().IntVar(&port, "status-port", 0, "serve lift status (JSON) over HTTP on this port while running")
+	RootCmd.PersistentFlags().StringVar(&bind, "status-bind", "127.0.0.1", "address to bind the status port to")
+	RootCmd.PersistentFlags().BoolVar(&confirm, "confirm-destructive", false, "ask before running destructive stages (only on a terminal)")
+	RootCmd.PersistentFlags().BoolVar(&rescue, "rescue", false, "only set up networking, DNS and sshd (rescue mode)")
 	RootCmd.PersistentFlags().StringArrayVarP(&headers, "request-header", "H", nil, "HTTP header(s) to include in request, akin to curl's -H")
 	_ = viper.BindPFlag("debug", RootCmd.PersistentFlags().Lookup("debug"))
 	_ = viper.BindPFlag("alpine-data-url", RootCmd.PersistentFlags().Lookup("alpine-data-url"))
 	_ = viper.BindPFlag("request-header", RootCmd.PersistentFlags().Lookup("request-header"))
 	_ = viper.BindPFlag("json", RootCmd.PersistentFlags().Lookup("json"))
 	_ = viper.BindPFlag("no-color", RootCmd.PersistentFlags().Lookup("no-color"))
+	_ = viper.BindPFlag("silent", RootCmd.PersistentFlags().Lookup("silent"))
+	_ = viper.BindPFlag("offline", RootCmd.PersistentFlags().Lookup("offline"))
+	_ = viper.BindPFlag("dry-run", RootCmd.PersistentFlags().Lookup("dry-run"))
+	_ = viper.BindPFlag("status-file", RootCmd.PersistentFlags().Lookup("status-file"))
+	_ = viper.BindPFlag("metrics-url", RootCmd.PersistentFlags().Lookup("metrics-url"))
+	_ = viper.BindPFlag("status-port", RootCmd.PersistentFlags().Lookup("status-port"))
+	_ = viper.BindPFlag("status-bind", RootCmd.PersistentFlags().Lookup("status-bind"))
+	_ = viper.BindPFlag("confirm-destructive", RootCmd.PersistentFlags().Lookup("confirm-destructive"))
+	_ = viper.BindPFlag("rescue", RootCmd.PersistentFlags().Lookup("rescue"))
+}
+
+// returns the function asking the operator to confirm destructive stages. When
+// not running on a terminal (e.g. on boot) nothing is asked.
+func confirmFunc() lift.ConfirmFunc {
+	if !viper.GetBool("confirm-destructive") {
+		return nil
+	}
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	in := bufio.NewReader(os.Stdin)
+	return func(stage string, destroys []string) bool {
+		fmt.Printf("Stage %s will destroy:\n", stage)
+		for _, d := range destroys {
+			fmt.Printf("  - %s\n", d)
+		}
+		fmt.Print("Continue? [y/N] ")
+		answer, _ := in.ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
+
+// returns the address to serve the status on, empty when disabled
+func statusAddr() string {
+	if viper.GetInt("status-port") <= 0 {
+		return ""
+	}
+	return net.JoinHostPort(viper.GetString("status-bind"), strconv.Itoa(viper.GetInt("status-port")))
+}
+
+// applies the logging flags
+func setupLogging() {
+	if viper.GetBool("debug") {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	if viper.GetBool("no-color") {
+		logFormat = log.TextFormatter{
+			ForceColors:     false,
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02T15:04:05.999999999",
+		}
+	}
+
+	if viper.GetBool("json") {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+}
+
+// parses the request header flags, exits on invalid headers
+func requestHeaders() map[string][]string {
+	headers := make(map[string][]string)
+	for _, h := range viper.GetStringSlice("request-headers") {
+		words := strings.SplitN(h, ":", 2)
+		key := strings.TrimSpace(words[0])
+		value := strings.TrimSpace(words[1])
+		if key == "" || value == "" {
+			log.Errorf("Invalid request header: %s", h)
+			log.Error("Lift aborted")
+			os.Exit(1)
+		}
+		headers[key] = append(headers[key], value)
+	}
+	return headers
 }
 
 func initConfig() {
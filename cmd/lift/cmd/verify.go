@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bjwschaap/alpine-lift/pkg/lift"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	// Definition of the verify subcommand
+	verifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Check the system against the alpine-data, without changing anything",
+		Run: func(cmd *cobra.Command, args []string) {
+			setupLogging()
+			l, err := lift.New(viper.GetString("alpine-data-url"), requestHeaders(),
+				lift.WithOffline(viper.GetBool("offline")),
+			)
+			if err != nil {
+				log.Error(err)
+				os.Exit(1)
+			}
+			found, err := l.Verify()
+			if err != nil {
+				log.Error(err)
+				log.Error("Verify aborted")
+				os.Exit(1)
+			}
+			for _, d := range found {
+				fmt.Println(d)
+			}
+			if len(found) > 0 {
+				log.Errorf("Found %d discrepancies", len(found))
+				os.Exit(1)
+			}
+			log.Info("System matches alpine-data")
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+}
@@ -0,0 +1,240 @@
+package lift
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultAPKUpdateRetries = 3
+	mirrorCheckTimeout      = 10 * time.Second
+	alpineReleaseFile       = "/etc/alpine-release"
+)
+
+// UnreachableRepositories returns the repositories that were found to be
+// unreachable. These are written (commented out) after the reachable ones.
+func (p *PackagesConfig) UnreachableRepositories() []string {
+	return p.unreachable
+}
+
+// returns the number of times a failed apk update is retried
+func (p *PackagesConfig) updateRetries() int {
+	if p.UpdateRetries == 0 {
+		return defaultAPKUpdateRetries
+	}
+	if p.UpdateRetries < 0 {
+		return 0
+	}
+	return p.UpdateRetries
+}
+
+// reorders the repositories, so the unreachable ones are left out. When none
+// of them is reachable, they are all kept. Tagged repositories are always
+// kept, as they are the only source of their name@tag packages.
+func (l *Lift) checkMirrors() {
+	p := l.Data.Packages
+	if len(p.Repositories) < 2 || l.offline {
+		return
+	}
+	var kept RepositoryList
+	var unreachable []string
+	reachable := 0
+	for _, repo := range p.Repositories {
+		switch {
+		case l.mirrorReachable(repo.URL):
+			kept = append(kept, repo)
+			if repo.Tag == "" {
+				reachable++
+			}
+		case repo.Tag != "":
+			l.log.WithField("repository", repo.String()).Warn("Tagged repository unreachable, keeping it")
+			kept = append(kept, repo)
+		default:
+			l.log.WithField("repository", repo.String()).Warn("Repository unreachable")
+			unreachable = append(unreachable, repo.String())
+		}
+	}
+	if reachable == 0 && len(unreachable) > 0 {
+		l.log.Warn("None of the repositories is reachable, keeping all of them")
+		return
+	}
+	l.log.WithField("repository", kept[0].String()).Info("Using mirror")
+	p.Repositories, p.unreachable = kept, unreachable
+}
+
+// returns true when the (http) repository responds. Local repositories are
+// always considered reachable.
+func (l *Lift) mirrorReachable(repo string) bool {
+	if !strings.HasPrefix(repo, "http://") && !strings.HasPrefix(repo, "https://") {
+		return true
+	}
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", repo, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := (&http.Client{Timeout: mirrorCheckTimeout}).Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// runs apk update, retrying with an exponential backoff
+func (l *Lift) apkUpdate() error {
+	retries := l.Data.Packages.updateRetries()
+	delay := 2 * time.Second
+	var err error
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			l.log.WithField("attempt", i+1).Warnf("apk update failed, retrying in %s: %v", delay, err)
+			if err := l.sleep(delay); err != nil {
+				return err
+			}
+			delay *= 2
+		}
+		if err = l.runCmd("apk", "update"); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("apk update failed after %d attempts: %v", retries+1, err)
+}
+
+// runs apk upgrade. Upgradable packages matching one of the upgrade_exclude
+// patterns are held back, by only upgrading the other packages.
+func (l *Lift) apkUpgrade() error {
+	if len(l.Data.Packages.UpgradeExclude) == 0 {
+		return l.runCmd("apk", "upgrade")
+	}
+	var out bytes.Buffer
+	cmd := l.command("apk", "list", "--upgradable")
+	cmd.Stdout = &out
+	if err := l.run(cmd); err != nil {
+		return fmt.Errorf("unable to list upgradable packages: %v", err)
+	}
+	var upgrade []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := packageName(fields[0])
+		if l.Data.Packages.upgradeExcluded(name) {
+			l.log.WithField("package", name).Info("Holding back package upgrade")
+			continue
+		}
+		upgrade = append(upgrade, name)
+	}
+	if len(upgrade) == 0 {
+		l.log.Debug("No packages to upgrade")
+		return nil
+	}
+	return l.runCmd("apk", append([]string{"upgrade"}, upgrade...)...)
+}
+
+// returns true when the package matches one of the upgrade_exclude patterns
+func (p *PackagesConfig) upgradeExcluded(name string) bool {
+	for _, pattern := range p.UpgradeExclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// strips the version (<version>-r<release>) from an apk package identifier
+func packageName(id string) string {
+	parts := strings.Split(id, "-")
+	if len(parts) < 3 {
+		return id
+	}
+	return strings.Join(parts[:len(parts)-2], "-")
+}
+
+// placeholders available in repository urls
+type repositoryVars struct {
+	Version string // major.minor of the running Alpine release, or edge
+	Branch  string // repository branch: v<major.minor>, or edge
+	Arch    string // machine architecture (uname -m)
+}
+
+// expands the {{ .Version }} and {{ .Arch }} placeholders in the repositories
+func (l *Lift) expandRepositories() error {
+	p := l.Data.Packages
+	var vars *repositoryVars
+	for i := range p.Repositories {
+		repo := p.Repositories[i].URL
+		if !strings.Contains(repo, "{{") {
+			continue
+		}
+		if vars == nil {
+			v, err := systemRepositoryVars()
+			if err != nil {
+				return err
+			}
+			vars = &v
+		}
+		t, err := template.New("repository").Option("missingkey=error").Parse(repo)
+		if err != nil {
+			return fmt.Errorf("invalid repository %q: %v", repo, err)
+		}
+		var b bytes.Buffer
+		if err = t.Execute(&b, vars); err != nil {
+			return fmt.Errorf("invalid repository %q: %v", repo, err)
+		}
+		l.log.WithField("repository", b.String()).Debugf("Expanded %s", repo)
+		p.Repositories[i].URL = b.String()
+	}
+	return nil
+}
+
+// returns the Alpine version and architecture of the running system
+func systemRepositoryVars() (repositoryVars, error) {
+	release, err := ioutil.ReadFile(alpineReleaseFile)
+	if err != nil {
+		return repositoryVars{}, fmt.Errorf("unable to determine Alpine version: %v", err)
+	}
+	var uname syscall.Utsname
+	if err = syscall.Uname(&uname); err != nil {
+		return repositoryVars{}, fmt.Errorf("unable to determine architecture: %v", err)
+	}
+	var arch []byte
+	for _, c := range uname.Machine {
+		if c == 0 {
+			break
+		}
+		arch = append(arch, byte(c))
+	}
+	vars := repositoryVars{Version: alpineVersion(string(release)), Arch: string(arch)}
+	vars.Branch = "v" + vars.Version
+	if vars.Version == "edge" {
+		vars.Branch = vars.Version
+	}
+	return vars, nil
+}
+
+// returns the major.minor version of an Alpine release (e.g. 3.19 for 3.19.1).
+// Development snapshots (e.g. 3.20_alpha20240315) are edge.
+func alpineVersion(release string) string {
+	release = strings.TrimSpace(release)
+	if strings.Contains(release, "_") {
+		return "edge"
+	}
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return release
+	}
+	return parts[0] + "." + parts[1]
+}
@@ -0,0 +1,64 @@
+package lift
+
+import "fmt"
+
+// ConfirmFunc is asked to confirm a destructive stage before it runs. It
+// receives the stage name and a description of everything the stage destroys,
+// and returns false to abort lift.
+type ConfirmFunc func(stage string, destroys []string) bool
+
+// WithConfirm makes lift ask confirm before running a destructive stage
+// (e.g. formatting disks or uninstalling packages)
+func WithConfirm(confirm ConfirmFunc) Option {
+	return func(l *Lift) {
+		l.confirm = confirm
+	}
+}
+
+// returns what the stage destroys when it runs, nothing for stages that
+// are not destructive
+func (l *Lift) destroys(name string) []string {
+	var d []string
+	switch name {
+	case "raid":
+		for _, a := range l.Data.RAID {
+			if !a.Assemble {
+				d = append(d, fmt.Sprintf("all data on %v (creating RAID array %s)", a.Members, a.Device))
+			}
+		}
+	case "lvm":
+		if l.Data.LVM != nil {
+			for _, pv := range l.Data.LVM.PhysicalVolumes {
+				d = append(d, fmt.Sprintf("all data on %s (creating LVM physical volume)", pv))
+			}
+		}
+	case "scratchdisk":
+		if l.Data.ScratchDisk != "" {
+			d = append(d, fmt.Sprintf("all data on %s (formatting scratch disk)", l.Data.ScratchDisk))
+		}
+	case "disks":
+		for _, disk := range l.Data.Disks {
+			d = append(d, fmt.Sprintf("all data on %s (encrypting and formatting)", disk.Device))
+		}
+	case "apk":
+		if l.Data.Packages != nil {
+			for _, p := range l.Data.Packages.Uninstall {
+				d = append(d, fmt.Sprintf("package %s (uninstalling)", p))
+			}
+		}
+	}
+	return d
+}
+
+// asks for confirmation of a destructive stage, returns an error when it
+// was declined
+func (l *Lift) confirmStage(name string) error {
+	if l.confirm == nil || l.dryRun {
+		return nil
+	}
+	d := l.destroys(name)
+	if len(d) == 0 || l.confirm(name, d) {
+		return nil
+	}
+	return fmt.Errorf("stage %s was not confirmed", name)
+}
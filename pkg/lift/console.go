@@ -0,0 +1,71 @@
+package lift
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	consoleFontConfFile = "/etc/conf.d/consolefont"
+	consoleBlankScript  = "/etc/local.d/lift-consoleblank.start"
+)
+
+// configures the console font, screen blanking and numlock
+func (l *Lift) consoleSetup() error {
+	c := l.Data.Console
+	if c == nil {
+		return nil
+	}
+	if c.Font != "" {
+		l.log.WithField("font", c.Font).Debug("Setting console font")
+		if err := l.runCmd("apk", "add", "kbd", "kbd-misc"); err != nil {
+			return err
+		}
+		conf := fmt.Sprintf("consolefont=%q\n", c.Font)
+		if err := l.writeFileAtomic(consoleFontConfFile, []byte(conf), 0644, ""); err != nil {
+			return err
+		}
+		if err := l.doService("consolefont", ENABLE, bootRunlevel); err != nil {
+			return err
+		}
+		if err := l.doService("consolefont", RESTART); err != nil {
+			return err
+		}
+	}
+	if c.BlankTime != 0 {
+		// the kernel has no setting for this (other than the consoleblank
+		// boot parameter), so it is set on every boot through local.d
+		minutes := c.BlankTime
+		if minutes < 0 {
+			minutes = 0
+		}
+		l.log.Debugf("Setting console blank time to %d minutes (%s)", minutes, consoleBlankScript)
+		script := fmt.Sprintf("#!/bin/sh\nfor tty in /dev/tty[1-6]; do\n\tprintf '\\033[9;%d]' > \"$tty\"\ndone\n", minutes)
+		if err := l.writeFileAtomic(consoleBlankScript, []byte(script), 0755, ""); err != nil {
+			return err
+		}
+		if err := l.doService("local", ENABLE, defaultRunlevel); err != nil {
+			return err
+		}
+		if err := l.runCmd("sh", consoleBlankScript); err != nil {
+			return err
+		}
+	}
+	if c.NumLock {
+		l.log.Debug("Enabling numlock on the console")
+		if err := l.doService("numlock", ENABLE, defaultRunlevel); err != nil {
+			return err
+		}
+		if err := l.doService("numlock", START); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ConsoleConfig) validate() error {
+	if strings.ContainsAny(c.Font, "/ ") {
+		return fmt.Errorf("console: invalid font %q", c.Font)
+	}
+	return nil
+}
@@ -1,27 +1,89 @@
 package lift
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 // AlpineData is the main alpine-data yaml specification
 type AlpineData struct {
-	RootPasswd  string            `yaml:"password"`
-	MOTD        string            `yaml:"motd"`
-	Network     *NetworkSettings  `yaml:"network"`
-	Packages    *PackagesConfig   `yaml:"packages"`
-	DRP         *DRProvision      `yaml:"dr_provision"`
-	SSHDConfig  *SSHD             `yaml:"sshd"`
-	Groups      MultiString       `yaml:"groups"`
-	Users       []User            `yaml:"users"`
-	RunCMD      []MultiString     `yaml:"runcmd"`
-	WriteFiles  []WriteFile       `yaml:"write_files"`
-	TimeZone    string            `yaml:"timezone"`
-	Keymap      string            `yaml:"keymap"`
-	UnLift      bool              `yaml:"unlift"`
-	ScratchDisk string            `yaml:"scratch_disk"`
-	Disks       []Disk            `yaml:"disks"`
-	MTA         *MTAConfiguration `yaml:"mta"`
+	RootPasswd            string                      `yaml:"password"`
+	RootPasswdLock        bool                        `yaml:"lock_password"`
+	RootPasswdHashed      bool                        `yaml:"password_hashed"`
+	MOTD                  string                      `yaml:"motd"`
+	Network               *NetworkSettings            `yaml:"network"`
+	Packages              *PackagesConfig             `yaml:"packages"`
+	DRP                   *DRProvision                `yaml:"dr_provision"`
+	SSHDConfig            *SSHD                       `yaml:"sshd"`
+	Groups                MultiString                 `yaml:"groups"`
+	Users                 []User                      `yaml:"users"`
+	BootCMD               []MultiString               `yaml:"bootcmd"`
+	RunCMD                []MultiString               `yaml:"runcmd"`
+	StageHooks            map[string]StageHook        `yaml:"stage_hooks"`
+	WriteFiles            []WriteFile                 `yaml:"write_files"`
+	TimeZone              string                      `yaml:"timezone"`
+	Keymap                string                      `yaml:"keymap"`
+	UnLift                bool                        `yaml:"unlift"`
+	ScratchDisk           string                      `yaml:"scratch_disk"`
+	ScratchDiskFS         MultiString                 `yaml:"scratch_disk_fs"`
+	ScratchDiskMountOpts  string                      `yaml:"scratch_disk_mount_opts"`
+	ScratchDiskMode       string                      `yaml:"scratch_disk_mode"`
+	ScratchDiskMountPoint string                      `yaml:"scratch_disk_mountpoint"`
+	ScratchDiskUnmount    MultiString                 `yaml:"scratch_disk_unmount"`
+	RAID                  []RAIDArray                 `yaml:"raid"`
+	LVM                   *LVMConfig                  `yaml:"lvm"`
+	Disks                 []Disk                      `yaml:"disks"`
+	MTA                   *MTAConfiguration           `yaml:"mta"`
+	Download              *DownloadConfig             `yaml:"download"`
+	Firewall              *FirewallConfig             `yaml:"firewall"`
+	Fail2Ban              *Fail2BanConfig             `yaml:"fail2ban"`
+	OpenVPN               []OVPNClient                `yaml:"openvpn"`
+	Services              []Service                   `yaml:"services"`
+	Console               *ConsoleConfig              `yaml:"console"`
+	SetupScripts          []SetupScript               `yaml:"setup_scripts"`
+	WriteRelease          bool                        `yaml:"write_release"`
+	DisableSwap           bool                        `yaml:"disable_swap"`
+	ContinueOnError       bool                        `yaml:"continue_on_error"`
+	DeviceTimeout         int                         `yaml:"device_timeout"`
+	CommandTimeout        int                         `yaml:"command_timeout"`  // seconds
+	CommandTimeouts       map[string]int              `yaml:"command_timeouts"` // seconds, per stage
+	MinFreeSpace          int                         `yaml:"min_free_space"`   // MiB
+	Templates             map[string]TemplateOverride `yaml:"templates"`
+}
+
+// returns the setup-disk mode for the scratch disk, data by default
+func (d *AlpineData) scratchDiskMode() string {
+	if d.ScratchDiskMode == "" {
+		return "data"
+	}
+	return strings.ToLower(d.ScratchDiskMode)
+}
+
+// returns where the data scratch disk ends up being mounted
+func (d *AlpineData) scratchDiskMountPoint() string {
+	if d.ScratchDiskMountPoint == "" {
+		return "/var"
+	}
+	return d.ScratchDiskMountPoint
+}
+
+// TemplateOverride replaces a built-in template, by a template file or
+// inline template content
+type TemplateOverride struct {
+	Path    string `yaml:"path"`
+	Content string `yaml:"content"`
+}
+
+// StageHook specifies commands to run right before and after a stage
+type StageHook struct {
+	Pre  []string `yaml:"pre"`
+	Post []string `yaml:"post"`
 }
 
 // User specifies a specific OS user
@@ -36,16 +98,61 @@ type User struct {
 	System            bool        `yaml:"system"`
 	SSHAuthorizedKeys []string    `yaml:"ssh_authorized_keys"`
 	Password          string      `yaml:"passwd"`
+	PasswordHash      string      `yaml:"hashed_passwd"`
+	Locked            bool        `yaml:"lock_passwd"`
+	Expiry            string      `yaml:"expiredate"`
+	PasswordMaxDays   int         `yaml:"password_max_days"`
 }
 
 // SSHD specifies the `sshd` entry
 type SSHD struct {
-	Port                   int      `yaml:"port"`
-	ListenAddress          string   `yaml:"listen_address"`
-	AuthorizedKeys         []string `yaml:"authorized_keys"`
-	PermitRootLogin        bool     `yaml:"permit_root_login"`
-	PermitEmptyPasswords   bool     `yaml:"permit_empty_passwords"`
-	PasswordAuthentication bool     `yaml:"password_authentication"`
+	Port                   int       `yaml:"port"`
+	ListenAddress          string    `yaml:"listen_address"`
+	AuthorizedKeys         []string  `yaml:"authorized_keys"`
+	AuthorizedKeysURL      string    `yaml:"authorized_keys_url"`
+	AuthorizedKeysPath     string    `yaml:"authorized_keys_path"`
+	PermitRootLogin        bool      `yaml:"permit_root_login"`
+	PermitEmptyPasswords   bool      `yaml:"permit_empty_passwords"`
+	PasswordAuthentication bool      `yaml:"password_authentication"`
+	HostKeys               []HostKey `yaml:"host_keys"`
+}
+
+// HostKey is an SSH host key to install, instead of the generated one.
+// The key pair is given inline, or downloaded from a url.
+type HostKey struct {
+	Type          string `yaml:"type"`
+	PrivateKey    string `yaml:"private_key"`
+	PrivateKeyURL string `yaml:"private_key_url"`
+	PublicKey     string `yaml:"public_key"`
+	PublicKeyURL  string `yaml:"public_key_url"`
+}
+
+// returns the path of the private key file for the host key
+func (k HostKey) path() string {
+	return fmt.Sprintf("/etc/ssh/ssh_host_%s_key", k.Type)
+}
+
+func (k HostKey) validate() error {
+	switch k.Type {
+	case "rsa", "ecdsa", "ed25519":
+	default:
+		return fmt.Errorf("sshd: invalid host key type %q", k.Type)
+	}
+	if (k.PrivateKey == "") == (k.PrivateKeyURL == "") {
+		return fmt.Errorf("sshd: %s host key needs either a private_key or a private_key_url", k.Type)
+	}
+	if k.PublicKey != "" && k.PublicKeyURL != "" {
+		return fmt.Errorf("sshd: %s host key can't have both a public_key and a public_key_url", k.Type)
+	}
+	return nil
+}
+
+// returns the authorized_keys file to add the keys to, root's by default
+func (s *SSHD) authorizedKeysPath() string {
+	if s.AuthorizedKeysPath == "" {
+		return rootAuthorizedKeysFile
+	}
+	return s.AuthorizedKeysPath
 }
 
 // DRProvision is used for installing and configuring drpcli
@@ -55,15 +162,210 @@ type DRProvision struct {
 	Token         string `yaml:"token"`
 	Endpoint      string `yaml:"endpoint"`
 	UUID          string `yaml:"uuid"`
+	DRPCLISHA256  string `yaml:"drpcli_sha256"` // expected checksum of the drpcli binary
 }
 
 // NetworkSettings contains all network settings lift should apply
 type NetworkSettings struct {
-	HostName      string               `yaml:"hostname"`
-	InterfaceOpts string               `yaml:"interfaces"`
-	ResolvConf    *ResolvConfiguration `yaml:"resolv_conf"`
-	Proxy         string               `yaml:"proxy"`
-	NTP           *NTPConfiguration    `yaml:"ntp"`
+	HostName      string      `yaml:"hostname"`
+	HostEntries   []HostEntry `yaml:"hosts"`
+	InterfaceOpts string      `yaml:"interfaces"`
+	Interfaces    []Interface `yaml:"interface_config"`
+	Bonds         []Bond      `yaml:"bonds"`
+	VLANs         []VLAN      `yaml:"vlans"`
+	Routes        []Route     `yaml:"routes"`
+	// template (local path or url) rendering the whole interfaces file
+	InterfacesTemplate string               `yaml:"interfaces_template"`
+	ResolvConf         *ResolvConfiguration `yaml:"resolv_conf"`
+	Proxy              string               `yaml:"proxy"`
+	NTP                *NTPConfiguration    `yaml:"ntp"`
+	// retry restarting networking until DHCP interfaces have a lease (opt-in)
+	RestartRetries int `yaml:"restart_retries"`
+	RestartDelay   int `yaml:"restart_delay"`
+	// don't fail when restarting networking fails
+	IgnoreRestartErrors bool `yaml:"ignore_restart_errors"`
+	// interfaces get addresses, but there is no default route (no internet)
+	Isolated bool `yaml:"isolated"`
+	// auto (default), disable or only
+	IPv6 string `yaml:"ipv6"`
+}
+
+// IPv6Mode returns the IPv6 mode: auto (default), disable or only
+func (n *NetworkSettings) IPv6Mode() string {
+	if n.IPv6 == "" {
+		return "auto"
+	}
+	return strings.ToLower(n.IPv6)
+}
+
+// Interface specifies the configuration of a single network interface.
+// Method is dhcp (default), static, manual or loopback.
+type Interface struct {
+	Name    string      `yaml:"name"`
+	Method  string      `yaml:"method"`
+	Address string      `yaml:"address"` // CIDR notation, e.g. 10.0.0.2/24
+	Netmask string      `yaml:"netmask"` // when the address is not in CIDR notation
+	Gateway string      `yaml:"gateway"`
+	Use     MultiString `yaml:"use"` // extra ifupdown-ng executors, e.g. bond
+	MTU     int         `yaml:"mtu"`
+	// IPv6 (besides IPv4): static, dhcp or auto (SLAAC)
+	IPv6Mode    string `yaml:"ipv6_mode"`
+	IPv6Address string `yaml:"ipv6_address"` // CIDR notation, e.g. 2001:db8::2/64
+	IPv6Gateway string `yaml:"ipv6_gateway"`
+	// set for the bonds in network.bonds
+	BondSlaves MultiString `yaml:"-"`
+	BondMode   string      `yaml:"-"`
+	// set for the vlans in network.vlans
+	VLANRawDevice string `yaml:"-"`
+	VLANID        int    `yaml:"-"`
+	// the routes in network.routes going through this interface
+	Routes []Route `yaml:"-"`
+	// DNS for this interface only (requires resolvconf)
+	DNSNameServers MultiString `yaml:"dns_nameservers"`
+	DNSSearch      MultiString `yaml:"dns_search"`
+}
+
+// InetMethod returns the configuration method of the interface
+func (i Interface) InetMethod() string {
+	if i.Method == "" {
+		return "dhcp"
+	}
+	return strings.ToLower(i.Method)
+}
+
+// Bond specifies a bonded interface, with the same (address) settings as
+// an interface. The slaves are configured as manual interfaces.
+type Bond struct {
+	Interface `yaml:",inline"`
+	Slaves    MultiString `yaml:"slaves"`
+	Mode      string      `yaml:"mode"` // e.g. 802.3ad or active-backup
+}
+
+// VLAN specifies a VLAN (tagged) interface on top of a parent interface, with
+// the same (address) settings as an interface. The name defaults to
+// <parent>.<id>, e.g. eth0.100.
+type VLAN struct {
+	Interface       `yaml:",inline"`
+	ParentInterface string `yaml:"parent"`
+	VLANID          int    `yaml:"id"`
+}
+
+// VLANName returns the name of the VLAN interface
+func (v VLAN) VLANName() string {
+	if v.Name != "" {
+		return v.Name
+	}
+	return fmt.Sprintf("%s.%d", v.ParentInterface, v.VLANID)
+}
+
+// AllInterfaces returns the interfaces to write to the interfaces file:
+// the configured interfaces, followed by the slaves and bonds, and the vlans
+func (n *NetworkSettings) AllInterfaces() []Interface {
+	all := append([]Interface{}, n.Interfaces...)
+	for _, b := range n.Bonds {
+		for _, s := range b.Slaves {
+			all = append(all, Interface{Name: s, Method: "manual"})
+		}
+		i := b.Interface
+		i.BondSlaves, i.BondMode = b.Slaves, b.Mode
+		all = append(all, i)
+	}
+	for _, v := range n.VLANs {
+		i := v.Interface
+		i.Name, i.VLANRawDevice, i.VLANID = v.VLANName(), v.ParentInterface, v.VLANID
+		all = append(all, i)
+	}
+	for _, r := range n.Routes {
+		for k := range all {
+			if all[k].Name == r.Interface || r.Interface == "" && all[k].reaches(r.Gateway) {
+				all[k].Routes = append(all[k].Routes, r)
+				break
+			}
+		}
+	}
+	return all
+}
+
+// HostEntry specifies an extra /etc/hosts line
+type HostEntry struct {
+	IP        string      `yaml:"ip"`
+	Hostnames MultiString `yaml:"hostnames"`
+}
+
+// Route specifies a static route. Without an interface, the route is added
+// (when the interface comes up) to the interface that has the gateway in its subnet.
+type Route struct {
+	Destination string `yaml:"destination"` // CIDR notation, e.g. 10.10.0.0/16
+	Gateway     string `yaml:"gateway"`
+	Interface   string `yaml:"interface"`
+}
+
+// IPRoute returns the arguments for `ip route add`
+func (r Route) IPRoute() string {
+	s := r.Destination
+	if r.Gateway != "" {
+		s += " via " + r.Gateway
+	}
+	if r.Interface != "" {
+		s += " dev " + r.Interface
+	}
+	return s
+}
+
+// returns true when ip is in the subnet of one of the (static) interface addresses
+func (i Interface) reaches(ip string) bool {
+	gw := net.ParseIP(ip)
+	if gw == nil {
+		return false
+	}
+	for _, a := range []string{i.CIDRAddress(), i.IPv6Address} {
+		if _, n, err := net.ParseCIDR(a); err == nil && n.Contains(gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPv6Method returns the IPv6 configuration method of the interface, empty
+// when IPv6 is not configured
+func (i Interface) IPv6Method() string {
+	return strings.ToLower(i.IPv6Mode)
+}
+
+// CIDRAddress returns the address in CIDR notation, taking the prefix
+// length from the netmask when the address has none
+func (i Interface) CIDRAddress() string {
+	if i.Address == "" || i.Netmask == "" || strings.Contains(i.Address, "/") {
+		return i.Address
+	}
+	mask := net.ParseIP(i.Netmask).To4()
+	if mask == nil {
+		return i.Address
+	}
+	ones, bits := net.IPMask(mask).Size()
+	if bits == 0 {
+		// not a valid (contiguous) netmask
+		return i.Address
+	}
+	return fmt.Sprintf("%s/%d", i.Address, ones)
+}
+
+// Domain returns the domain part of the (fully qualified) hostname
+func (n *NetworkSettings) Domain() string {
+	parts := strings.SplitN(n.HostName, ".", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// DNSDomain returns the configured DNS domain, or the domain of the
+// hostname when it was not set explicitly
+func (n *NetworkSettings) DNSDomain() string {
+	if n.ResolvConf != nil && n.ResolvConf.Domain != "" {
+		return n.ResolvConf.Domain
+	}
+	return n.Domain()
 }
 
 // ResolvConfiguration contains the DNS spec
@@ -71,17 +373,77 @@ type ResolvConfiguration struct {
 	NameServers   MultiString `yaml:"nameservers"`
 	SearchDomains MultiString `yaml:"search_domains"`
 	Domain        string      `yaml:"domain"`
+	Options       MultiString `yaml:"options"`
+	Direct        bool        `yaml:"direct"`
 }
 
 // NTPConfiguration is used for configuring chronyd
 type NTPConfiguration struct {
-	Pools   MultiString `yaml:"pools"`
-	Servers MultiString `yaml:"servers"`
+	Pools           MultiString   `yaml:"pools"`
+	Servers         NTPServerList `yaml:"servers"`
+	DisableDefaults bool          `yaml:"disable_defaults"`
+	Implementation  string        `yaml:"implementation"`
+	MakeStep        string        `yaml:"makestep"`
+	HWClockWrite    bool          `yaml:"hwclock_write"`
+	// chrony: wait (up to a minute) until the clock is synchronised
+	WaitForSync bool `yaml:"wait_for_sync"`
+	// fail when the NTP daemon can't be restarted, or the clock isn't synchronised
+	Strict bool `yaml:"strict"`
+}
+
+// NTPServer is a NTP server, with its (chrony) server options,
+// e.g. prefer, iburst or minpoll 4
+type NTPServer struct {
+	Address string   `yaml:"address"`
+	Options []string `yaml:"options"`
+}
+
+// UnmarshalYAML accepts both a server address and a server structure
+func (s *NTPServer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*s = NTPServer{Address: address}
+		return nil
+	}
+	type plain NTPServer
+	return unmarshal((*plain)(s))
+}
+
+// String returns the address of the server
+func (s NTPServer) String() string {
+	return s.Address
+}
+
+// ChronyOptions returns the options for the chrony server directive
+func (s NTPServer) ChronyOptions() string {
+	if len(s.Options) == 0 {
+		return "iburst maxsources 3"
+	}
+	return strings.Join(s.Options, " ")
+}
+
+// NTPServerList is a list of NTP servers, that can also be given as a single server
+type NTPServerList []NTPServer
+
+// UnmarshalYAML accepts both a list of servers and a single server
+func (sl *NTPServerList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var servers []NTPServer
+	if err := unmarshal(&servers); err == nil {
+		*sl = servers
+		return nil
+	}
+	var s NTPServer
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	*sl = NTPServerList{s}
+	return nil
 }
 
 // MTAConfiguration contains all information for setting up a
 // mail transfer agent (mail forwarding)
 type MTAConfiguration struct {
+	Provider         string `yaml:"provider"` // ssmtp (default) or msmtp
 	Root             string `yaml:"root"`
 	Server           string `yaml:"server"`
 	UseTLS           bool   `yaml:"use_tls"`
@@ -91,26 +453,284 @@ type MTAConfiguration struct {
 	AuthMethod       string `yaml:"authmethod"`
 	RewriteDomain    string `yaml:"rewrite_domain"`
 	FromLineOverride bool   `yaml:"fromline_override"`
+	RootAlias        string `yaml:"root_alias"`
+	TestRecipient    string `yaml:"test_recipient"`
+	FailOnTestError  bool   `yaml:"fail_on_test_error"`
+}
+
+// FirewallConfig specifies the `firewall` entry. All incoming traffic is
+// dropped, except for established connections, loopback, ICMP and the rules.
+type FirewallConfig struct {
+	Backend string         `yaml:"backend"`
+	Rules   []FirewallRule `yaml:"rules"`
+}
+
+// FirewallRule allows incoming traffic on a port, optionally only from source
+type FirewallRule struct {
+	Port   int    `yaml:"port"`
+	Proto  string `yaml:"proto"`
+	Source string `yaml:"source"`
+}
+
+// Protocol returns the protocol of the rule, tcp by default
+func (r FirewallRule) Protocol() string {
+	if r.Proto == "" {
+		return "tcp"
+	}
+	return strings.ToLower(r.Proto)
+}
+
+// Service specifies a service to enable and start, optionally after
+// other (listed) services were started. State selects what is done
+// instead: enabled, disabled, started and/or stopped. Runlevel is the
+// openrc runlevel the service is enabled in (or disabled from).
+type Service struct {
+	Name     string      `yaml:"name"`
+	After    MultiString `yaml:"after"`
+	State    MultiString `yaml:"state"`
+	Runlevel string      `yaml:"runlevel"`
+}
+
+// returns the runlevel of the service, default by default
+func (s Service) runlevel() string {
+	if s.Runlevel == "" {
+		return defaultRunlevel
+	}
+	return s.Runlevel
+}
+
+// returns the desired states of the service, enabled and started by default
+func (s Service) states() map[string]bool {
+	states := make(map[string]bool)
+	for _, st := range s.State {
+		states[strings.ToLower(st)] = true
+	}
+	if len(states) == 0 {
+		states["enabled"], states["started"] = true, true
+	}
+	return states
+}
+
+// makes sure the states are known and don't contradict each other
+func (s Service) validate() error {
+	states := s.states()
+	for st := range states {
+		switch st {
+		case "enabled", "disabled", "started", "stopped":
+		default:
+			return fmt.Errorf("services: unknown state %q for %s (enabled, disabled, started or stopped)", st, s.Name)
+		}
+	}
+	if states["enabled"] && states["disabled"] || states["started"] && states["stopped"] {
+		return fmt.Errorf("services: contradicting states for %s", s.Name)
+	}
+	switch s.runlevel() {
+	case sysinitRunlevel, bootRunlevel, defaultRunlevel, shutdownRunlevel:
+	default:
+		return fmt.Errorf("services: unknown runlevel %q for %s (sysinit, boot, default or shutdown)", s.Runlevel, s.Name)
+	}
+	return nil
+}
+
+// OVPNClient specifies an OpenVPN client, using an inline or downloaded
+// .ovpn profile. The password can be taken from the environment instead.
+type OVPNClient struct {
+	Name        string `yaml:"name"`
+	Profile     string `yaml:"profile"`
+	ProfileURL  string `yaml:"profile_url"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	PasswordEnv string `yaml:"password_env"`
+}
+
+// Fail2BanConfig specifies the `fail2ban` entry
+type Fail2BanConfig struct {
+	Enable   bool           `yaml:"enable"`
+	BanTime  string         `yaml:"bantime"`
+	FindTime string         `yaml:"findtime"`
+	MaxRetry int            `yaml:"maxretry"`
+	Jails    []Fail2BanJail `yaml:"jails"`
+}
+
+// Fail2BanJail is a single (enabled) fail2ban jail
+type Fail2BanJail struct {
+	Name     string `yaml:"name"`
+	Port     string `yaml:"port"`
+	Filter   string `yaml:"filter"`
+	LogPath  string `yaml:"logpath"`
+	MaxRetry int    `yaml:"maxretry"`
+}
+
+// DownloadConfig limits the files lift downloads (write_files, drpcli, etc.)
+type DownloadConfig struct {
+	MaxSize int64 `yaml:"max_size"` // bytes
+	Timeout int   `yaml:"timeout"`  // seconds, per request
+	// retries of failed downloads (network errors, 5xx), with a delay that
+	// doubles after every retry
+	Retries    int `yaml:"retries"`
+	RetryDelay int `yaml:"retry_delay"` // seconds
+}
+
+// MTAProvider returns the MTA that is set up: ssmtp (default) or msmtp
+func (m *MTAConfiguration) MTAProvider() string {
+	if m.Provider == "" {
+		return "ssmtp"
+	}
+	return strings.ToLower(m.Provider)
+}
+
+// Host returns the host part of the server (host:port)
+func (m *MTAConfiguration) Host() string {
+	if host, _, err := net.SplitHostPort(m.Server); err == nil {
+		return host
+	}
+	return m.Server
+}
+
+// Port returns the port part of the server (host:port), "" when not given
+func (m *MTAConfiguration) Port() string {
+	if _, port, err := net.SplitHostPort(m.Server); err == nil {
+		return port
+	}
+	return ""
+}
+
+// MSMTPAuth returns the msmtp auth setting: the (lowercase) auth method, or
+// on to let msmtp choose one
+func (m *MTAConfiguration) MSMTPAuth() string {
+	if m.AuthMethod == "" {
+		return "on"
+	}
+	return strings.ToLower(m.AuthMethod)
 }
 
 // PackagesConfig contains specification for the `packages:` block.
 type PackagesConfig struct {
-	Repositories MultiString `yaml:"repositories"`
-	Update       bool        `yaml:"update"`
-	Upgrade      bool        `yaml:"upgrade"`
-	Install      MultiString `yaml:"install"`
-	Uninstall    MultiString `yaml:"uninstall"`
+	Repositories RepositoryList `yaml:"repositories"`
+	Update       bool           `yaml:"update"`
+	Upgrade      bool           `yaml:"upgrade"`
+	// packages (glob patterns, e.g. linux-*) held back during upgrade
+	UpgradeExclude MultiString `yaml:"upgrade_exclude"`
+	Install        PackageList `yaml:"install"`
+	Uninstall      MultiString `yaml:"uninstall"`
+	// retries of a failed apk update (default 3, -1 to disable)
+	UpdateRetries int `yaml:"update_retries"`
+	// persistent package cache (setup-apkcache), e.g. on the scratch disk
+	CacheDir string `yaml:"cache_dir"`
+
+	unreachable []string
 }
 
 // WriteFile allows for specifying files and their content
 // that should be created on first boot.
 type WriteFile struct {
-	Encoding    string `yaml:"encoding"`
+	Encoding    string `yaml:"encoding"` // b64, gzip or gzip+base64 (default: plain text)
 	Content     string `yaml:"content"`
 	ContentURL  string `yaml:"content-url"`
+	ContentPath string `yaml:"content-path"`
 	Path        string `yaml:"path"`
 	Owner       string `yaml:"owner"`
 	Permissions string `yaml:"permissions"`
+	Overwrite   *bool  `yaml:"overwrite"`
+	Immutable   bool   `yaml:"immutable"`
+	SHA256      string `yaml:"sha256"`   // expected checksum of the content as fetched (before decoding)
+	Append      bool   `yaml:"append"`   // append to an existing file instead of replacing it
+	Template    bool   `yaml:"template"` // render the content as a template (see Templates)
+	// mode of the parent directories that are created. Default: 0711
+	DirPermissions string `yaml:"dir_permissions"`
+}
+
+// returns the file mode from the (octal) permissions, 0644 by default
+func (wf WriteFile) mode() (os.FileMode, error) {
+	return parseMode(wf.Permissions, 0644, "permissions", wf.Path)
+}
+
+// returns the mode for the parent directories of the file
+func (wf WriteFile) dirMode() (os.FileMode, error) {
+	return parseMode(wf.DirPermissions, 0711, "dir_permissions", wf.Path)
+}
+
+// parses an octal mode (644, 0644 or 0o644), def when s is empty. The
+// setuid, setgid and sticky bits are converted to their os.FileMode bits.
+func parseMode(s string, def os.FileMode, key, path string) (os.FileMode, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	octal := s
+	if strings.HasPrefix(s, "0o") || strings.HasPrefix(s, "0O") {
+		octal = s[2:]
+	}
+	perm, err := strconv.ParseUint(octal, 8, 32)
+	if err != nil || perm > 07777 {
+		return 0, fmt.Errorf("write_files: invalid %s %q for %s (octal, e.g. 0644)", key, s, path)
+	}
+	mode := os.FileMode(perm).Perm()
+	for bit, m := range map[uint64]os.FileMode{04000: os.ModeSetuid, 02000: os.ModeSetgid, 01000: os.ModeSticky} {
+		if perm&bit != 0 {
+			mode |= m
+		}
+	}
+	return mode, nil
+}
+
+// makes sure the content is given in at most one way
+func (wf WriteFile) validate() error {
+	n := 0
+	for _, s := range []string{wf.Content, wf.ContentURL, wf.ContentPath} {
+		if s != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("write_files: %s can only have one of content, content-url and content-path", wf.Path)
+	}
+	if wf.ContentPath != "" && !filepath.IsAbs(wf.ContentPath) {
+		return fmt.Errorf("write_files: content-path %q of %s must be an absolute path", wf.ContentPath, wf.Path)
+	}
+	switch wf.encoding() {
+	case "", "base64", "gzip", "gzip+base64":
+	default:
+		return fmt.Errorf("write_files: unknown encoding %q for %s (b64, gzip or gzip+base64)", wf.Encoding, wf.Path)
+	}
+	if wf.Append && !wf.overwrite() {
+		return fmt.Errorf("write_files: append and overwrite: false are mutually exclusive for %s", wf.Path)
+	}
+	if wf.SHA256 != "" && !isSHA256(wf.SHA256) {
+		return fmt.Errorf("write_files: sha256 of %s must be 64 hexadecimal characters", wf.Path)
+	}
+	if wf.Template && wf.Content != "" && wf.encoding() == "" {
+		if _, err := parseContentTemplate(wf.Path, wf.Content); err != nil {
+			return fmt.Errorf("write_files: %v", err)
+		}
+	}
+	if _, err := wf.dirMode(); err != nil {
+		return err
+	}
+	_, err := wf.mode()
+	return err
+}
+
+// returns the normalized encoding of the content (the cloud-init aliases
+// are accepted), "" for plain text
+func (wf WriteFile) encoding() string {
+	switch e := strings.ToLower(wf.Encoding); e {
+	case "", "text", "text/plain":
+		return ""
+	case "b64", "base64":
+		return "base64"
+	case "gz", "gzip":
+		return "gzip"
+	case "gz+b64", "gz+base64", "gzip+b64", "gzip+base64":
+		return "gzip+base64"
+	default:
+		return e
+	}
+}
+
+// returns true when an existing file may be overwritten (default)
+func (wf WriteFile) overwrite() bool {
+	return wf.Overwrite == nil || *wf.Overwrite
 }
 
 // Disk specifies a disk that should be formatted and mounted
@@ -121,6 +741,47 @@ type Disk struct {
 	MountPoint     string `yaml:"mountpoint"`
 }
 
+// RAIDArray specifies a software (mdadm) RAID array that should be
+// created, or assembled from existing members
+type RAIDArray struct {
+	Device   string      `yaml:"device"`
+	Level    string      `yaml:"level"`
+	Members  MultiString `yaml:"members"`
+	Assemble bool        `yaml:"assemble"`
+	Force    bool        `yaml:"force"`
+}
+
+// LVMConfig specifies a LVM volume group, the physical volumes it
+// consists of and the logical volumes to create in it
+type LVMConfig struct {
+	PhysicalVolumes MultiString     `yaml:"physical_volumes"`
+	VolumeGroup     string          `yaml:"volume_group"`
+	LogicalVolumes  []LogicalVolume `yaml:"logical_volumes"`
+}
+
+// LogicalVolume specifies a LVM logical volume. The size is either absolute
+// (e.g. 10G) or relative (e.g. 100%FREE).
+type LogicalVolume struct {
+	Name string `yaml:"name"`
+	Size string `yaml:"size"`
+}
+
+// SetupScript is an Alpine setup script (setup-<name>) to run, e.g. xorg-base
+type SetupScript struct {
+	Name  string   `yaml:"name"`
+	Args  []string `yaml:"args"`
+	Stdin string   `yaml:"stdin"`
+}
+
+// ConsoleConfig contains the settings of the (physical) console
+type ConsoleConfig struct {
+	// console font, from /usr/share/consolefonts (e.g. ter-v16n)
+	Font string `yaml:"font"`
+	// minutes of inactivity before the screen is blanked, -1 never blanks
+	BlankTime int  `yaml:"blank_time"`
+	NumLock   bool `yaml:"numlock"`
+}
+
 // MultiString is a type alias, needed for unmarshalling
 type MultiString []string
 
@@ -143,14 +804,160 @@ func (ms *MultiString) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
-var silent bool
+// Repository is an apk repository. Packages can be installed from a tagged
+// repository only (name@tag). In yaml it is either the url (optionally
+// prefixed with @tag), or a structure.
+type Repository struct {
+	URL string `yaml:"url"`
+	Tag string `yaml:"tag"`
+}
+
+// UnmarshalYAML accepts both a repository line and a repository structure
+func (r *Repository) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var line string
+	if err := unmarshal(&line); err != nil {
+		type plain Repository
+		return unmarshal((*plain)(r))
+	}
+	*r = Repository{URL: strings.TrimSpace(line)}
+	if strings.HasPrefix(r.URL, "@") {
+		if f := strings.Fields(r.URL); len(f) == 2 {
+			r.Tag, r.URL = f[0][1:], f[1]
+		}
+	}
+	return nil
+}
+
+// String returns the repository as written in /etc/apk/repositories
+func (r Repository) String() string {
+	if r.Tag == "" {
+		return r.URL
+	}
+	return "@" + r.Tag + " " + r.URL
+}
+
+// RepositoryList is a list of repositories, that can also be given as a
+// single repository
+type RepositoryList []Repository
+
+// UnmarshalYAML accepts both a list of repositories and a single repository
+func (rl *RepositoryList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var repos []Repository
+	if err := unmarshal(&repos); err == nil {
+		*rl = repos
+		return nil
+	}
+	var r Repository
+	if err := unmarshal(&r); err != nil {
+		return err
+	}
+	*rl = RepositoryList{r}
+	return nil
+}
+
+// returns true when one of the repositories has the tag
+func (rl RepositoryList) hasTag(tag string) bool {
+	for _, r := range rl {
+		if r.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Package specifies a package to install, optionally pinned to a version
+// and/or a tagged repository, with commands to run right after it was
+// installed. In yaml it is either just the name (name@tag=version for
+// pinning), or a structure.
+type Package struct {
+	Name        string   `yaml:"name"`
+	Version     string   `yaml:"version"`
+	Tag         string   `yaml:"tag"`
+	PostInstall []string `yaml:"post_install"`
+}
+
+// UnmarshalYAML accepts both a package name and a package structure
+func (p *Package) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*p = Package{Name: name}
+	} else {
+		type plain Package
+		if err := unmarshal((*plain)(p)); err != nil {
+			return err
+		}
+	}
+	if i := strings.Index(p.Name, "="); i >= 0 && p.Version == "" {
+		p.Name, p.Version = p.Name[:i], p.Name[i+1:]
+	}
+	if i := strings.Index(p.Name, "@"); i >= 0 && p.Tag == "" {
+		p.Name, p.Tag = p.Name[:i], p.Name[i+1:]
+	}
+	return nil
+}
+
+// returns the package as passed to apk add: name[@tag][=version]
+func (p Package) apkName() string {
+	name := p.Name
+	if p.Tag != "" {
+		name += "@" + p.Tag
+	}
+	if p.Version != "" {
+		name += "=" + p.Version
+	}
+	return name
+}
+
+// apk package versions, e.g. 1.24.0-r3 or 2.4_rc1-r0
+var apkVersion = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*[a-z]?(_(alpha|beta|pre|rc|cvs|svn|git|hg|p)[0-9]*)*(-r[0-9]+)?$`)
+
+// makes sure the package has a name, a valid apk version (if pinned) and
+// a repository with its tag (if tagged)
+func (p Package) validate(repos RepositoryList) error {
+	if p.Name == "" {
+		return errors.New("packages: install entry without a name")
+	}
+	if p.Version != "" && !apkVersion.MatchString(p.Version) {
+		return fmt.Errorf("packages: invalid version %q for %s (e.g. 1.2.3-r0)", p.Version, p.Name)
+	}
+	if p.Tag != "" && !repos.hasTag(p.Tag) {
+		return fmt.Errorf("packages: no repository tagged @%s for %s", p.Tag, p.Name)
+	}
+	return nil
+}
+
+// PackageList is a list of packages, that can also be given as a single package
+type PackageList []Package
+
+// UnmarshalYAML accepts both a list of packages and a single package
+func (pl *PackageList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var packages []Package
+	if err := unmarshal(&packages); err == nil {
+		*pl = packages
+		return nil
+	}
+	var p Package
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	*pl = PackageList{p}
+	return nil
+}
+
+// Defaults for downloads
+const (
+	defaultDownloadMaxSize    = 256 << 20 // 256MiB
+	defaultDownloadTimeout    = 300       // seconds
+	defaultDownloadRetries    = 3
+	defaultDownloadRetryDelay = 2 // seconds
+)
 
 // InitAlpineData initializes alpine-data with sane defaults
 func InitAlpineData() *AlpineData {
 	return &AlpineData{
-		UnLift:   true,
-		TimeZone: "UTC",
-		Keymap:   "us us",
+		UnLift:        true,
+		Keymap:        "us us",
+		ScratchDiskFS: MultiString{"xfs"},
 		Network: &NetworkSettings{
 			HostName: "alpine",
 		},
@@ -164,10 +971,16 @@ func InitAlpineData() *AlpineData {
 		DRP: &DRProvision{
 			InstallRunner: true,
 		},
+		Download: &DownloadConfig{
+			MaxSize:    defaultDownloadMaxSize,
+			Timeout:    defaultDownloadTimeout,
+			Retries:    defaultDownloadRetries,
+			RetryDelay: defaultDownloadRetryDelay,
+		},
 		Packages: &PackagesConfig{
-			Repositories: []string{
-				"http://dl-cdn.alpinelinux.org/alpine/v3.8/main",
-				"http://dl-cdn.alpinelinux.org/alpine/v3.8/community",
+			Repositories: RepositoryList{
+				{URL: "http://dl-cdn.alpinelinux.org/alpine/v3.8/main"},
+				{URL: "http://dl-cdn.alpinelinux.org/alpine/v3.8/community"},
 			},
 		},
 	}
@@ -175,13 +988,18 @@ func InitAlpineData() *AlpineData {
 
 // Returns a key-value map with SSH settings from alpine-data
 func (l *Lift) getSSHDKVMap() map[string]string {
-	return map[string]string{
+	kv := map[string]string{
 		"Port":                   strconv.Itoa(l.Data.SSHDConfig.Port),
 		"ListenAddress":          l.Data.SSHDConfig.ListenAddress,
 		"PermitRootLogin":        boolToYesNo(l.Data.SSHDConfig.PermitRootLogin),
 		"PermitEmptyPasswords":   boolToYesNo(l.Data.SSHDConfig.PermitEmptyPasswords),
 		"PasswordAuthentication": boolToYesNo(l.Data.SSHDConfig.PasswordAuthentication),
 	}
+	// a locked root account should only be reachable using keys
+	if l.Data.RootPasswdLock {
+		kv["PasswordAuthentication"] = "no"
+	}
+	return kv
 }
 
 // Converts bool values to either "yes" or "no"
@@ -0,0 +1,31 @@
+package lift
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// checks there is at least min_free_space free on / and the (data) scratch
+// disk, before anything is downloaded or installed
+func (l *Lift) diskSpaceCheck() error {
+	if l.Data.MinFreeSpace <= 0 {
+		return nil
+	}
+	paths := []string{"/"}
+	if l.Data.ScratchDisk != "" && l.Data.scratchDiskMode() == "data" {
+		paths = append(paths, l.Data.scratchDiskMountPoint())
+	}
+	min := uint64(l.Data.MinFreeSpace) << 20
+	for _, path := range paths {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(path, &fs); err != nil {
+			return fmt.Errorf("unable to determine free space on %s: %v", path, err)
+		}
+		free := fs.Bavail * uint64(fs.Bsize)
+		l.log.WithField("path", path).Debugf("%d MiB free", free>>20)
+		if free < min {
+			return fmt.Errorf("not enough free space on %s: %d MiB free, min_free_space is %d MiB", path, free>>20, l.Data.MinFreeSpace)
+		}
+	}
+	return nil
+}
@@ -1,25 +1,246 @@
 package lift
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 )
 
-// DownloadFile returns a file from http(s)
-func downloadFile(url string, headers http.Header) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+const fileURLPrefix = "file://"
+
+// alpine-data url for reading the alpine-data from stdin
+const stdinURL = "-"
+
+// errOffline is returned when a network download is attempted in offline mode
+var errOffline = errors.New("network downloads are disabled in offline mode")
+
+// DownloadFile returns a file from http(s), or from the local filesystem
+// for file:// urls
+func (l *Lift) downloadFile(url string, headers http.Header) ([]byte, error) {
+	if isLocalURL(url) {
+		return l.readLocalFile(strings.TrimPrefix(url, fileURLPrefix))
+	}
+	if l.offline {
+		return nil, errOffline
+	}
+	retries, delay := l.downloadRetries()
+	for attempt := 1; ; attempt++ {
+		data, err := l.download(url, headers)
+		if err == nil || attempt > retries || !retryable(err) {
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return data, err
+		}
+		l.log.WithField("url", url).Warnf("Download failed (attempt %d of %d), retrying in %s: %v", attempt, retries+1, delay, err)
+		if err = l.sleep(delay); err != nil {
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// downloads url once (over http(s))
+func (l *Lift) download(url string, headers http.Header) ([]byte, error) {
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	maxSize, timeout := l.downloadLimits()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = headers
-	resp, err := http.DefaultClient.Do(req)
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &httpStatusError{"GET", url, resp.Status, resp.StatusCode}
+	}
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("GET %s: size of %d bytes exceeds maximum of %d bytes", url, resp.ContentLength, maxSize)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("GET %s: download exceeds maximum of %d bytes", url, maxSize)
+	}
 	return data, nil
 }
+
+// reads a file from the local filesystem, within the download size limit
+func (l *Lift) readLocalFile(path string) ([]byte, error) {
+	maxSize, _ := l.downloadLimits()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > maxSize {
+		return nil, fmt.Errorf("%s: size of %d bytes exceeds maximum of %d bytes", path, fi.Size(), maxSize)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// reads all of stdin, within the download size limit
+func (l *Lift) readStdin() ([]byte, error) {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return nil, errors.New("alpine-data should be piped into stdin, not read from a terminal")
+	}
+	maxSize, _ := l.downloadLimits()
+	data, err := ioutil.ReadAll(io.LimitReader(os.Stdin, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read alpine-data from stdin: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("alpine-data on stdin exceeds maximum of %d bytes", maxSize)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.New("no alpine-data on stdin")
+	}
+	return data, nil
+}
+
+// returns the maximum size and timeout for downloads
+func (l *Lift) downloadLimits() (int64, time.Duration) {
+	maxSize, timeout := int64(defaultDownloadMaxSize), time.Duration(defaultDownloadTimeout)*time.Second
+	if l.Data.Download != nil {
+		if l.Data.Download.MaxSize > 0 {
+			maxSize = l.Data.Download.MaxSize
+		}
+		if l.Data.Download.Timeout > 0 {
+			timeout = time.Duration(l.Data.Download.Timeout) * time.Second
+		}
+	}
+	return maxSize, timeout
+}
+
+// returns the number of retries and the (initial) delay between them for
+// downloads. The delay doubles after every retry.
+func (l *Lift) downloadRetries() (int, time.Duration) {
+	retries, delay := defaultDownloadRetries, defaultDownloadRetryDelay
+	if l.Data != nil && l.Data.Download != nil {
+		retries, delay = l.Data.Download.Retries, l.Data.Download.RetryDelay
+	}
+	if delay <= 0 {
+		delay = defaultDownloadRetryDelay
+	}
+	return retries, time.Duration(delay) * time.Second
+}
+
+// returns true when a download failed in a way that may be temporary:
+// a network error or a 5xx/429 response
+func retryable(err error) bool {
+	var hse *httpStatusError
+	var ue *url.Error
+	var ne net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &hse):
+		return hse.code >= 500 || hse.code == http.StatusTooManyRequests
+	case errors.As(err, &ue), errors.As(err, &ne), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	return false
+}
+
+// verifies the SHA-256 checksum of data (of what), when a checksum is given
+func verifySHA256(data []byte, want, what string) error {
+	if want == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, want) {
+		return fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", what, strings.ToLower(want), got)
+	}
+	return nil
+}
+
+// returns true when s is a hex encoded SHA-256 checksum
+func isSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// returns true when data starts with the gzip magic bytes
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// decompresses gzip data, within the download size limit
+func (l *Lift) gunzip(data []byte) ([]byte, error) {
+	maxSize, _ := l.downloadLimits()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(zr, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > maxSize {
+		return nil, fmt.Errorf("decompressed size exceeds maximum of %d bytes", maxSize)
+	}
+	return out, nil
+}
+
+// returns true when url refers to a file on the local filesystem
+func isLocalURL(url string) bool {
+	return strings.HasPrefix(url, fileURLPrefix)
+}
+
+// returns true (and logs why) when url can't be downloaded because
+// lift runs in offline mode
+func (l *Lift) skipOffline(url, what string) bool {
+	if !l.offline || isLocalURL(url) {
+		return false
+	}
+	l.log.WithField("url", url).Infof("Skipping %s: offline mode", what)
+	return true
+}
+
+// postJSON sends v, encoded as JSON, to url. It gives up after timeout, so an
+// unresponsive server can't keep lift from exiting.
+func postJSON(url string, v interface{}, timeout time.Duration) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpStatusError{"POST", url, resp.Status, resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package lift
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// ErrorCategory classifies the failure of a stage, e.g. to decide whether
+// retrying lift makes sense
+type ErrorCategory string
+
+// Error categories
+const (
+	CategoryValidation ErrorCategory = "validation" // invalid alpine-data or options
+	CategoryNetwork    ErrorCategory = "network"    // a download or network request failed
+	CategoryExec       ErrorCategory = "exec"       // an external command failed
+	CategoryOther      ErrorCategory = "other"
+)
+
+// StageError is returned by Run when a stage fails. Stage is empty when lift
+// failed before running any stage (e.g. on invalid alpine-data).
+type StageError struct {
+	Stage    string
+	Category ErrorCategory
+	Err      error
+}
+
+func (e *StageError) Error() string {
+	if e.Stage == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("stage %s failed: %v", e.Stage, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// StageErrors is returned by Run when stages failed with continue_on_error set
+type StageErrors []*StageError
+
+func (e StageErrors) Error() string {
+	var names []string
+	for _, se := range e {
+		names = append(names, se.Stage)
+	}
+	return fmt.Sprintf("stages failed: %s", strings.Join(names, ", "))
+}
+
+// httpStatusError is returned when a http request got a non-2xx response
+type httpStatusError struct {
+	method, url, status string
+	code                int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.url, e.status)
+}
+
+// wraps err in a StageError for stage, unless it already is one
+func stageError(stage string, err error) *StageError {
+	var se *StageError
+	if errors.As(err, &se) {
+		return se
+	}
+	return &StageError{Stage: stage, Category: categorize(err), Err: err}
+}
+
+// returns the category of err, based on the errors it wraps
+func categorize(err error) ErrorCategory {
+	var se *StageError
+	var hse *httpStatusError
+	var ue *url.Error
+	var ne net.Error
+	var ee *exec.ExitError
+	switch {
+	case errors.As(err, &se):
+		return se.Category
+	case errors.Is(err, errOffline), errors.As(err, &hse), errors.As(err, &ue), errors.As(err, &ne):
+		return CategoryNetwork
+	case errors.As(err, &ee), errors.Is(err, exec.ErrNotFound):
+		return CategoryExec
+	}
+	return CategoryOther
+}
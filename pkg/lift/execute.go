@@ -1,15 +1,18 @@
 package lift
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/docker/docker/pkg/mount"
@@ -18,12 +21,28 @@ import (
 )
 
 const (
-	drpcliBin      = "/usr/local/bin/drpcli"
-	drpcliRCFile   = "/etc/init.d/drpcli"
-	chronyConfFile = "/etc/chrony/chrony.conf"
-	ssmtpConfFile  = "/etc/ssmtp/ssmtp.conf"
+	drpcliBin              = "/usr/local/bin/drpcli"
+	drpcliRCFile           = "/etc/init.d/drpcli"
+	chronyConfFile         = "/etc/chrony/chrony.conf"
+	ntpdConfFile           = "/etc/conf.d/ntpd"
+	openntpdConf           = "/etc/ntpd.conf"
+	ssmtpRevaliasesFile    = "/etc/ssmtp/revaliases"
+	ssmtpConfFile          = "/etc/ssmtp/ssmtp.conf"
+	msmtprcFile            = "/etc/msmtprc"
+	msmtpAliasesFile       = "/etc/msmtp-aliases"
+	sendmailBin            = "/usr/sbin/sendmail"
+	fstabFile              = "/etc/fstab"
+	resolvConfFile         = "/etc/resolv.conf"
+	interfacesFile         = "/etc/network/interfaces"
+	hostsFile              = "/etc/hosts"
+	ipv6SysctlFile         = "/etc/sysctl.d/00-lift-ipv6.conf"
+	rootAuthorizedKeysFile = "/root/.ssh/authorized_keys"
+	apkRepositoriesFile    = "/etc/apk/repositories"
 )
 
+// statfs type of ext2, ext3 and ext4 filesystems
+const ext4SuperMagic = 0xEF53
+
 var (
 	fsPackage = map[string]string{
 		"xfs":   "xfsprogs",
@@ -34,60 +53,236 @@ var (
 		"jfs":   "jfsutils",
 		"ntfs":  "ntfs-3g-progs",
 	}
+
+	// mkfs options forcing creation on a disk that already contains a filesystem
+	mkfsForceOpt = map[string]string{
+		"xfs":   "-f",
+		"btrfs": "-f",
+		"ext2":  "-F",
+		"ext3":  "-F",
+		"ext4":  "-F",
+	}
 )
 
-// executes the `hostname` command, if hostname was provided in alpine-data
+// ntpImplementation describes how to install and configure an NTP daemon
+type ntpImplementation struct {
+	setupName string // name as known by setup-ntp -c
+	pkg       string
+	confFile  string
+	template  *template.Template
+	service   string
+}
+
+// returns the NTP implementation by name, chrony being the default
+func ntpImplementationFor(name string) (*ntpImplementation, error) {
+	switch strings.ToLower(name) {
+	case "", "chrony":
+		return &ntpImplementation{"chrony", "chrony", chronyConfFile, chronyConf, "chronyd"}, nil
+	case "ntpd", "busybox":
+		return &ntpImplementation{"busybox", "busybox-openrc", ntpdConfFile, ntpdConf, "ntpd"}, nil
+	case "openntpd":
+		return &ntpImplementation{"openntpd", "openntpd", openntpdConf, openntpdConfig, "openntpd"}, nil
+	}
+	return nil, fmt.Errorf("ntp: unknown implementation %q (chrony, ntpd or openntpd)", name)
+}
+
+// executes the `hostname` command, if hostname was provided in alpine-data.
+// Only the short name is set as hostname, the domain is persisted through
+// /etc/hosts (the FQDN is the canonical name), so `hostname -d` and
+// `dnsdomainname` return it.
 func (l *Lift) setHostname() error {
-	if l.Data.Network.HostName != "" {
+	if l.Data.Network != nil && l.Data.Network.HostName != "" {
 		host := strings.Split(l.Data.Network.HostName, ".")[0]
+		if domain := l.Data.Network.Domain(); domain != "" {
+			l.log.WithField("domain", domain).Debug("Hostname is fully qualified")
+		}
 
-		cmd := exec.Command("hostname", host)
-		if err := cmd.Run(); err != nil {
+		if err := l.runCmd("hostname", host); err != nil {
 			return err
 		}
 
-		cmd = exec.Command("setup-hostname", "-n", host)
-		if err := cmd.Run(); err != nil {
+		if err := l.runCmd("setup-hostname", "-n", host); err != nil {
 			return err
 		}
 
-		file, err := openOrCreate("/etc/hosts")
+		hosts, err := l.target(hostsFile)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		if _, err = file.WriteString(fmt.Sprintf("127.0.0.1\t%s %s\n", l.Data.Network.HostName, host)); err != nil {
+		if l.Data.Network.IPv6Mode() == "disable" {
+			l.log.Debugf("Removing IPv6 entries from %s", hostsFile)
+			if err := removeIPv6Hosts(hosts); err != nil {
+				return err
+			}
+		}
+		names := MultiString{l.Data.Network.HostName}
+		if host != l.Data.Network.HostName {
+			names = append(names, host)
+		}
+		entries := []HostEntry{{IP: "127.0.0.1", Hostnames: names}}
+		if l.Data.Network.IPv6Mode() == "only" {
+			entries = append(entries, HostEntry{IP: "::1", Hostnames: names})
+		}
+		// the names must resolve to the FQDN, so drop them from other lines
+		// (e.g. written before the domain was set)
+		for _, e := range entries {
+			if err := removeHostsNames(hosts, e.IP, l.Data.Network.HostName, names...); err != nil {
+				return err
+			}
+		}
+		if err := l.addHosts(entries); err != nil {
 			return err
 		}
 	}
+	if l.Data.Network != nil && len(l.Data.Network.HostEntries) > 0 {
+		return l.addHosts(l.Data.Network.HostEntries)
+	}
 	return nil
 }
 
-// mtaSetup installs and configures ssmtp as MTA
+// appends the entries to the hosts file, skipping the hostnames that are
+// already mapped to the same IP (so running lift again doesn't add them twice)
+func (l *Lift) addHosts(entries []HostEntry) error {
+	path, err := l.target(hostsFile)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool)
+	newline := false
+	if hosts, err := ioutil.ReadFile(path); err == nil {
+		// don't append to an unterminated last line
+		newline = len(hosts) > 0 && hosts[len(hosts)-1] != '\n'
+		for _, line := range strings.Split(string(hosts), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			for _, name := range fields[1:] {
+				present[fields[0]+" "+name] = true
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	file, err := openOrCreate(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, e := range entries {
+		var names []string
+		for _, name := range e.Hostnames {
+			if !present[e.IP+" "+name] {
+				present[e.IP+" "+name] = true
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		l.log.WithField("ip", e.IP).Debugf("Adding hosts entry for %s", strings.Join(names, " "))
+		if newline {
+			if _, err = file.WriteString("\n"); err != nil {
+				return err
+			}
+			newline = false
+		}
+		if _, err = file.WriteString(fmt.Sprintf("%s\t%s\n", e.IP, strings.Join(names, " "))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mtaSetup installs and configures ssmtp (or msmtp) as MTA
 func (l *Lift) mtaSetup() error {
 	if l.Data.MTA == nil {
-		log.Debug("No MTA configured")
+		l.log.Debug("No MTA configured")
 		return nil
 	}
 
-	log.Debug("apk add ssmtp")
-	cmd := exec.Command("apk", "add", "ssmtp")
-	if err := cmd.Run(); err != nil {
+	if l.Data.MTA.MTAProvider() == "msmtp" {
+		if err := l.msmtpSetup(); err != nil {
+			return err
+		}
+		return l.testMTA()
+	}
+
+	l.log.Debug("apk add ssmtp")
+	if err := l.runCmd("apk", "add", "ssmtp"); err != nil {
 		return err
 	}
 
-	log.Debug("Generating ssmtp.conf")
-	ssmtp, err := generateFileFromTemplate(*ssmtpConf, l.Data)
-	if err != nil {
+	l.log.Debugf("Generating %s", ssmtpConfFile)
+	if err := l.installTemplate(*ssmtpConf, ssmtpConfFile, 0600); err != nil {
+		return err
+	}
+
+	// ssmtp doesn't use /etc/aliases, the sender of root's mail is set in revaliases
+	if l.Data.MTA.RootAlias != "" {
+		l.log.Debugf("Generating %s", ssmtpRevaliasesFile)
+		if err := l.installTemplate(*revaliases, ssmtpRevaliasesFile, 0644); err != nil {
+			return err
+		}
+	}
+	return l.testMTA()
+}
+
+// installs and configures msmtp as MTA, with a sendmail symlink
+func (l *Lift) msmtpSetup() error {
+	l.log.Debug("apk add msmtp msmtp-openrc")
+	if err := l.runCmd("apk", "add", "msmtp", "msmtp-openrc"); err != nil {
 		return err
 	}
 
-	log.Debugf("Copying ssmtp.conf to %s", ssmtpConfFile)
-	cmd = exec.Command("mv", ssmtp, ssmtpConfFile)
-	if err := cmd.Run(); err != nil {
+	l.log.Debugf("Generating %s", msmtprcFile)
+	if err := l.installTemplate(*msmtprc, msmtprcFile, 0600); err != nil {
+		return err
+	}
+	if l.Data.MTA.Root != "" {
+		l.log.Debugf("Generating %s", msmtpAliasesFile)
+		if err := l.installTemplate(*msmtpAliases, msmtpAliasesFile, 0644); err != nil {
+			return err
+		}
+	}
+
+	l.log.Debugf("Linking %s to msmtp", sendmailBin)
+	sendmail, err := l.target(sendmailBin)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(sendmail); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	return os.Symlink("/usr/bin/msmtp", sendmail)
+}
 
+// sends the test mail, when a test recipient is configured
+func (l *Lift) testMTA() error {
+	if l.Data.MTA.TestRecipient != "" {
+		if err := l.sendTestMail(l.Data.MTA.TestRecipient); err != nil {
+			if l.Data.MTA.FailOnTestError {
+				return err
+			}
+			l.log.Warn(err)
+		}
+	}
+	return nil
+}
+
+// sends a test message through the MTA, to verify relaying and authentication
+func (l *Lift) sendTestMail(to string) error {
+	host, _ := os.Hostname()
+	msg := fmt.Sprintf("To: %s\nSubject: alpine-lift test mail from %s\n\nThe MTA of %s was configured by alpine-lift.\n", to, host, host)
+	var stderr bytes.Buffer
+	cmd := l.command("sendmail", "-t")
+	cmd.Stdin = strings.NewReader(msg)
+	cmd.Stderr = &stderr
+	l.log.WithField("recipient", to).Info("Sending test mail")
+	if err := l.run(cmd); err != nil {
+		return fmt.Errorf("sending test mail to %s failed: %v: %s", to, err, strings.TrimSpace(stderr.String()))
+	}
+	l.log.WithField("recipient", to).Info("Test mail sent")
 	return nil
 }
 
@@ -97,90 +292,236 @@ func (l *Lift) mtaSetup() error {
 // from being mounted correctly.
 func (l *Lift) scratchDiskSetup() error {
 	if l.Data.ScratchDisk == "" {
-		log.Debug("No Scratch Disk defined")
+		l.log.Debug("No Scratch Disk defined")
 		return nil
 	}
 
-	log.Debug("Check if Docker is running")
+	if err := l.waitForDevice(l.Data.ScratchDisk); err != nil {
+		return err
+	}
+
+	l.log.Debug("Check if Docker is running")
 	// Give Docker some time to start
-	time.Sleep(3 * time.Second)
+	if err := l.sleep(3 * time.Second); err != nil {
+		return err
+	}
 	dockerPresent := false
 	procs, err := ps.Processes()
 	if err != nil {
 		return err
 	}
-	log.WithField("numprocs", len(procs)).Debug("Fetch process list")
+	l.log.WithField("numprocs", len(procs)).Debug("Fetch process list")
 	for _, p := range procs {
-		log.Debugf("Process: %s", p.Executable())
+		l.log.Debugf("Process: %s", p.Executable())
 		if strings.Contains(strings.ToLower(p.Executable()), "docker") {
-			log.Debug("Docker process detected")
+			l.log.Debug("Docker process detected")
 			dockerPresent = true
 		}
 	}
 
+	releaseDocker := func() {}
 	if dockerPresent {
-		log.Info("Stopping Docker...")
-		_ = doService("docker", STOP)
+		l.log.Info("Stopping Docker...")
+		_ = l.doService("docker", STOP)
+		// Make sure Docker comes back when lift fails or is interrupted
+		releaseDocker = l.registerCleanup("start docker", func() error {
+			return l.doService("docker", START)
+		})
 		// Wait a little bit for Docker to stop
-		time.Sleep(2 * time.Second)
+		if err := l.sleep(2 * time.Second); err != nil {
+			return err
+		}
 	}
 
-	mnts, _ := mount.GetMounts()
-	for _, mnt := range mnts {
-		if strings.Contains(mnt.Mountpoint, "/var") {
-			log.Infof("Unmounting %s", mnt.Mountpoint)
-			cmd := exec.Command("umount", mnt.Mountpoint)
-			_ = cmd.Run()
-		}
+	for _, mp := range l.scratchDiskUnmounts() {
+		l.log.Infof("Unmounting %s", mp)
+		cmd := l.command("umount", mp)
+		_ = l.run(cmd)
 	}
 
-	log.WithField("disk", l.Data.ScratchDisk).Debug("Setup Scratch Disk")
-	cmd := exec.Command("setup-disk", "-q", "-m", "data", l.Data.ScratchDisk)
+	fsType, err := l.selectFilesystem(l.Data.ScratchDiskFS)
+	if err != nil {
+		return err
+	}
+
+	l.log.WithField("disk", l.Data.ScratchDisk).Debug("Setup Scratch Disk")
+	mode := l.Data.scratchDiskMode()
+	cmd := l.command("setup-disk", "-q", "-m", mode, l.Data.ScratchDisk)
 
 	// If not silenced, show setup-alpine output on stdout
-	if !silent {
+	if !l.silent {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 	}
 
-	env := append(os.Environ(), "VARFS=xfs")
+	fsVar := "VARFS"
+	if mode != "data" {
+		fsVar = "ROOTFS"
+	}
+	env := append(os.Environ(), fmt.Sprintf("%s=%s", fsVar, fsType))
 	env = append(env, fmt.Sprintf("ERASE_DISKS=%s", l.Data.ScratchDisk))
-	env = append(env, "MKFS_OPTS_VAR=-f")
+	env = append(env, fmt.Sprintf("MKFS_OPTS_VAR=%s", mkfsForceOpt[fsType]))
 	env = append(env, "DEFAULT_DISK=none")
 	cmd.Env = env
 
-	if err := cmd.Run(); err != nil {
+	if err := l.run(cmd); err != nil {
 		return err
 	}
 
+	if mp := l.Data.ScratchDiskMountPoint; mp != "" && mp != "/var" {
+		l.log.WithField("mountpoint", mp).Debug("Moving data disk from /var")
+		if err := l.runCmd("umount", "/var"); err != nil {
+			return err
+		}
+		fstab, err := l.target(fstabFile)
+		if err != nil {
+			return err
+		}
+		if err := updateFstabEntry(fstab, "/var", func(fields []string) {
+			fields[1] = mp
+		}); err != nil {
+			return err
+		}
+		dir, err := l.target(mp)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := l.runCmd("mount", mp); err != nil {
+			return err
+		}
+	}
+
+	if l.Data.ScratchDiskMountOpts != "" {
+		mp := l.Data.scratchDiskMountPoint()
+		l.log.WithField("options", l.Data.ScratchDiskMountOpts).Debugf("Setting %s mount options", mp)
+		fstab, err := l.target(fstabFile)
+		if err != nil {
+			return err
+		}
+		if err := updateFstabEntry(fstab, mp, func(fields []string) {
+			fields[3] = l.Data.ScratchDiskMountOpts
+		}); err != nil {
+			return err
+		}
+		if err := l.runCmd("mount", "-o", "remount", mp); err != nil {
+			return err
+		}
+	}
+
 	if dockerPresent {
-		log.Info("Starting Docker...")
-		_ = doService("docker", START)
+		releaseDocker()
+		l.log.Info("Starting Docker...")
+		_ = l.doService("docker", START)
+	}
+
+	if l.Data.DisableSwap {
+		// the swap stage takes care of it
+		return nil
 	}
 
 	// Check if swap was re-enabled
-	out, err := exec.Command("cat", "/proc/swap").Output()
+	out, err := ioutil.ReadFile("/proc/swaps")
 	if err != nil {
 		return nil
 	}
 	if !strings.Contains(string(out), l.Data.ScratchDisk) {
 		// just try, don't care about the result since we can't fix it here..
-		_ = exec.Command("swapon", "-a").Run()
+		_ = l.runCmd("swapon", "-a")
 	}
 
 	return nil
 }
 
+// disables swap and removes it from fstab, so it stays off after a reboot
+func (l *Lift) swapSetup() error {
+	if !l.Data.DisableSwap {
+		return nil
+	}
+	l.log.Info("Disabling swap")
+	if err := l.runCmd("swapoff", "-a"); err != nil {
+		return err
+	}
+	fstab, err := l.target(fstabFile)
+	if err != nil {
+		return err
+	}
+	return removeFstabSwap(fstab)
+}
+
+// returns the mountpoints to unmount before setting up the scratch disk:
+// scratch_disk_unmount when given, otherwise /var and everything below it.
+// Nested mountpoints come before their parents.
+func (l *Lift) scratchDiskUnmounts() []string {
+	var mps []string
+	if len(l.Data.ScratchDiskUnmount) > 0 {
+		mps = append(mps, l.Data.ScratchDiskUnmount...)
+	} else {
+		mnts, _ := mount.GetMounts(nil)
+		for _, mnt := range mnts {
+			if mnt.Mountpoint == "/var" || strings.HasPrefix(mnt.Mountpoint, "/var/") {
+				mps = append(mps, mnt.Mountpoint)
+			}
+		}
+	}
+	sort.SliceStable(mps, func(i, j int) bool {
+		return strings.Count(mps[i], "/") > strings.Count(mps[j], "/")
+	})
+	return mps
+}
+
+// returns the first filesystem (in order of preference) whose tools can be
+// installed
+func (l *Lift) selectFilesystem(candidates []string) (string, error) {
+	for _, fs := range candidates {
+		fs = strings.ToLower(fs)
+		if pkg, ok := fsPackage[fs]; ok {
+			if err := l.runCmd("apk", "add", "--no-cache", pkg); err != nil {
+				l.log.Warnf("Unable to install %s, not using %s: %v", pkg, fs, err)
+				continue
+			}
+		}
+		l.log.Infof("Using %s filesystem", fs)
+		return fs, nil
+	}
+	return "", fmt.Errorf("none of the filesystems %v can be installed", candidates)
+}
+
+// waits (up to device_timeout seconds) for the device node to appear
+func (l *Lift) waitForDevice(device string) error {
+	if l.dryRun {
+		return nil
+	}
+	deadline := time.Now().Add(time.Duration(l.Data.DeviceTimeout) * time.Second)
+	for {
+		if _, err := os.Stat(device); err == nil {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("device %s not found (waited %ds)", device, l.Data.DeviceTimeout)
+		}
+		l.log.WithField("device", device).Debug("Waiting for device")
+		if err := l.sleep(time.Second); err != nil {
+			return err
+		}
+	}
+}
+
 // Encrypt, Format and mount other disks if configured
 func (l *Lift) diskSetup() error {
 	if l.Data.Disks == nil {
-		log.Debug("No additional disks")
+		l.log.Debug("No additional disks")
 		return nil
 	}
 	for i, disk := range l.Data.Disks {
-		log.Debug("Installing cryptsetup package")
-		_ = exec.Command("apk", "add", "--no-cache", "cryptsetup").Run()
-		log.Debug("Generating random key")
+		if err := l.waitForDevice(disk.Device); err != nil {
+			return err
+		}
+		l.log.Debug("Installing cryptsetup package")
+		_ = l.runCmd("apk", "add", "--no-cache", "cryptsetup")
+		l.log.Debug("Generating random key")
 		rand.Seed(time.Now().UnixNano())
 		letterRunes := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 		b := make([]rune, 30)
@@ -188,48 +529,46 @@ func (l *Lift) diskSetup() error {
 			b[i] = letterRunes[rand.Intn(len(letterRunes))]
 		}
 		luksPass := string(b)
-		log.Debugf("Encrypting %s (LUKS)", disk.Device)
+		l.log.Debugf("Encrypting %s (LUKS)", disk.Device)
 		cmdStr := fmt.Sprintf("echo -n '%s' | cryptsetup luksFormat %s -", luksPass, disk.Device)
-		encryptCmd := exec.Command("ash", "-c", cmdStr)
+		encryptCmd := l.command("ash", "-c", cmdStr)
 		encryptCmd.Stdout = os.Stdout
-		if err := encryptCmd.Run(); err != nil {
+		if err := l.run(encryptCmd); err != nil {
 			return err
 		}
 
-		if log.GetLevel() == log.DebugLevel {
-			dumpCmd := exec.Command("cryptsetup", "luksDump", disk.Device)
+		if l.log.GetLevel() == log.DebugLevel {
+			dumpCmd := l.command("cryptsetup", "luksDump", disk.Device)
 			dumpCmd.Stdout = os.Stdout
-			_ = dumpCmd.Run()
+			_ = l.run(dumpCmd)
 		}
 
 		mapper := fmt.Sprintf("crypt%d", i)
-		log.Debugf("Opening %s as %s", disk.Device, mapper)
+		l.log.Debugf("Opening %s as %s", disk.Device, mapper)
 		cmdStr = fmt.Sprintf("echo -n '%s' | cryptsetup luksOpen %s %s -d -", luksPass, disk.Device, mapper)
-		openCmd := exec.Command("ash", "-c", cmdStr)
+		openCmd := l.command("ash", "-c", cmdStr)
 		openCmd.Stdout = os.Stdout
-		if err := openCmd.Run(); err != nil {
+		if err := l.run(openCmd); err != nil {
 			return err
 		}
 
 		// Check filesystem support and kernel modules. Ignore exit codes..
-		log.Debugf("Checking filesystem prerequisites")
-		_ = exec.Command("apk", "add", "--no-cache", fsPackage[strings.ToLower(disk.FileSystemType)]).Run()
-		_ = exec.Command("modprobe", strings.ToLower(disk.FileSystemType)).Run()
+		l.log.Debugf("Checking filesystem prerequisites")
+		_ = l.runCmd("apk", "add", "--no-cache", fsPackage[strings.ToLower(disk.FileSystemType)])
+		_ = l.runCmd("modprobe", strings.ToLower(disk.FileSystemType))
 
 		mapdevice := fmt.Sprintf("/dev/mapper/%s", mapper)
-		log.Debugf("Creating %s filesystem on %s", disk.FileSystemType, mapdevice)
-		cmd := exec.Command(fmt.Sprintf("mkfs.%s", strings.ToLower(disk.FileSystemType)), mapdevice)
-		if err := cmd.Run(); err != nil {
+		l.log.Debugf("Creating %s filesystem on %s", disk.FileSystemType, mapdevice)
+		cmd := l.command(fmt.Sprintf("mkfs.%s", strings.ToLower(disk.FileSystemType)), mapdevice)
+		if err := l.run(cmd); err != nil {
 			return err
 		}
-		log.Debugf("Creating mountpoint %s", disk.MountPoint)
-		cmd = exec.Command("mkdir", "-p", disk.MountPoint)
-		if err := cmd.Run(); err != nil {
+		l.log.Debugf("Creating mountpoint %s", disk.MountPoint)
+		if err := l.runCmd("mkdir", "-p", disk.MountPoint); err != nil {
 			return err
 		}
-		log.Debugf("Mounting %s on %s as %s", mapdevice, disk.MountPoint, disk.FileSystemType)
-		cmd = exec.Command("mount", "-t", strings.ToLower(disk.FileSystemType), mapdevice, disk.MountPoint)
-		if err := cmd.Run(); err != nil {
+		l.log.Debugf("Mounting %s on %s as %s", mapdevice, disk.MountPoint, disk.FileSystemType)
+		if err := l.runCmd("mount", "-t", strings.ToLower(disk.FileSystemType), mapdevice, disk.MountPoint); err != nil {
 			return err
 		}
 	}
@@ -238,40 +577,173 @@ func (l *Lift) diskSetup() error {
 
 // configures the network interface(s)
 func (l *Lift) networkSetup() error {
+	if l.Data.Network == nil {
+		l.log.Debug("No network configured")
+		return nil
+	}
 	var cmd *exec.Cmd
 
-	if l.Data.Network.InterfaceOpts == "" {
+	if l.Data.Network.IPv6Mode() == "disable" {
+		if err := l.disableIPv6(); err != nil {
+			return err
+		}
+	}
+	if l.Data.Network.InterfacesTemplate != "" {
+		if len(l.Data.Network.AllInterfaces()) > 0 || l.Data.Network.InterfaceOpts != "" {
+			l.log.Warn("interfaces_template is set, ignoring interfaces, interface_config, bonds, vlans and routes")
+		}
+		if err := l.installInterfacesTemplate(); err != nil {
+			return err
+		}
+	} else if len(l.Data.Network.AllInterfaces()) > 0 {
+		if l.Data.Network.InterfaceOpts != "" {
+			l.log.Warn("Both interfaces and interface_config are set, using interface_config")
+		}
+		// interface DNS settings are applied through resolvconf
+		if _, err := exec.LookPath("resolvconf"); err != nil {
+			for _, i := range l.Data.Network.Interfaces {
+				if len(i.DNSNameServers) > 0 || len(i.DNSSearch) > 0 {
+					l.log.WithField("interface", i.Name).Warn("resolvconf not installed, ignoring interface DNS settings")
+				}
+			}
+		}
+		// ifupdown-ng uses a (subtly) different dialect
+		t := interfaces
+		ng := l.exists("apk", "info", "-e", "ifupdown-ng")
+		if ng {
+			l.log.Debug("ifupdown-ng detected")
+			t = interfacesNG
+		}
+		if len(l.Data.Network.Bonds) > 0 {
+			if err := l.bondingSetup(ng); err != nil {
+				return err
+			}
+		}
+		if len(l.Data.Network.VLANs) > 0 {
+			if err := l.vlanSetup(); err != nil {
+				return err
+			}
+		}
+		// applied through setup-interfaces -i, like interfaces
+		l.log.Debugf("Generating %s", interfacesFile)
+		data, err := l.renderTemplate(*t)
+		if err != nil {
+			return err
+		}
+		if err = l.setupInterfaces(data); err != nil {
+			return err
+		}
+	} else if l.Data.Network.InterfaceOpts == "" {
 		// Do auto config
-		log.Debug("No interface specification defined; auto-config")
-		cmd = exec.Command("setup-interfaces", "-a")
+		l.log.Debug("No interface specification defined; auto-config")
+		cmd = l.command("setup-interfaces", "-a")
 	} else {
-		log.Debug("Apply interface specification")
-		cmd = exec.Command("setup-interfaces", "-i")
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
+		l.log.Debug("Apply interface specification")
+		if err := l.setupInterfaces([]byte(l.Data.Network.InterfaceOpts)); err != nil {
 			return err
 		}
-		io.WriteString(stdin, l.Data.Network.InterfaceOpts)
-		stdin.Close()
 	}
 
-	if err := cmd.Run(); err != nil {
-		return err
+	if cmd != nil {
+		if err := l.run(cmd); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if l.Data.Network.RestartRetries <= 0 {
+		err = l.doService("networking", RESTART)
+	} else {
+		err = l.restartNetworking()
+	}
+	if err != nil {
+		if !l.Data.Network.IgnoreRestartErrors {
+			return err
+		}
+		l.log.Warnf("Ignoring networking restart failure: %v", err)
+	}
+	if l.Data.Network.Isolated {
+		l.removeDefaultRoutes()
 	}
+	return nil
+}
 
-	if err := doService("networking", RESTART); err != nil {
-		log.Infof("%v", err)
+// removes the default routes (e.g. obtained through DHCP) of an isolated network
+func (l *Lift) removeDefaultRoutes() {
+	for _, family := range []string{"-4", "-6"} {
+		if err := l.runCmd("ip", family, "route", "del", "default"); err == nil {
+			l.log.Infof("Removed default route (isolated network, ip %s)", family)
+		}
 	}
+}
 
+// feeds the contents of the interfaces file to setup-interfaces -i. In
+// dry-run mode, where setup-interfaces doesn't run, the contents are
+// written to the dry-run copy instead.
+func (l *Lift) setupInterfaces(data []byte) error {
+	cmd := l.command("setup-interfaces", "-i")
+	cmd.Stdin = bytes.NewReader(data)
+	if err := l.run(cmd); err != nil {
+		return err
+	}
+	if l.dryRun {
+		return l.writeFileAtomic(interfacesFile, data, 0644, "")
+	}
 	return nil
 }
 
+// restarts networking until all DHCP interfaces obtained a lease, or
+// the configured number of retries is exhausted
+func (l *Lift) restartNetworking() error {
+	delay := time.Duration(l.Data.Network.RestartDelay) * time.Second
+	if delay <= 0 {
+		delay = 5 * time.Second
+	}
+	// the interfaces file this run generated (the copy in dry-run mode)
+	path, err := l.target(interfacesFile)
+	if err != nil {
+		return err
+	}
+	dhcp, err := dhcpInterfaces(path)
+	if err != nil {
+		return err
+	}
+
+	attempts := l.Data.Network.RestartRetries + 1
+	var missing []string
+	var restartErr error
+	for i := 1; i <= attempts; i++ {
+		l.log.WithField("attempt", i).Info("Restarting networking")
+		if restartErr = l.doService("networking", RESTART); restartErr != nil {
+			l.log.WithField("attempt", i).Warnf("Restarting networking failed: %v", restartErr)
+		}
+		if err = l.sleep(delay); err != nil {
+			return err
+		}
+		missing = missing[:0]
+		for _, iface := range dhcp {
+			if !hasIPv4Address(iface) {
+				missing = append(missing, iface)
+			}
+		}
+		if restartErr == nil && len(missing) == 0 {
+			return nil
+		}
+		if len(missing) > 0 {
+			l.log.WithField("attempt", i).Warnf("No DHCP lease yet on %s", strings.Join(missing, ", "))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no DHCP lease obtained on %s after %d attempts", strings.Join(missing, ", "), attempts)
+	}
+	return fmt.Errorf("restarting networking failed after %d attempts: %v", attempts, restartErr)
+}
+
 // sets the proxy
 func (l *Lift) proxySetup() error {
-	if l.Data.Network.Proxy != "" {
-		log.WithField("proxy", l.Data.Network.Proxy).Debug("Found proxy setting")
-		cmd := exec.Command("setup-proxy", l.Data.Network.Proxy)
-		if err := cmd.Run(); err != nil {
+	if l.Data.Network != nil && l.Data.Network.Proxy != "" {
+		l.log.WithField("proxy", l.Data.Network.Proxy).Debug("Found proxy setting")
+		if err := l.runCmd("setup-proxy", l.Data.Network.Proxy); err != nil {
 			return err
 		}
 	}
@@ -280,6 +752,10 @@ func (l *Lift) proxySetup() error {
 
 // sets root password if needed
 func (l *Lift) rootPasswdSetup() error {
+	if l.Data.RootPasswdLock {
+		l.log.Debug("Locking root password")
+		return l.runCmd("passwd", "-l", "root")
+	}
 	// Always set a password, randomized if empty..
 	if l.Data.RootPasswd == "" {
 		rand.Seed(time.Now().UnixNano())
@@ -290,23 +766,16 @@ func (l *Lift) rootPasswdSetup() error {
 		}
 		l.Data.RootPasswd = string(b)
 	}
-	chpasswdCmd := exec.Command("chpasswd")
-	reader, writer := io.Pipe()
-	s := []byte(fmt.Sprintf("root:%s\n", l.Data.RootPasswd))
-
+	var args []string
+	if l.Data.RootPasswdHashed {
+		// the password is already hashed (crypt format, e.g. $6$...)
+		args = append(args, "-e")
+	}
+	chpasswdCmd := l.command("chpasswd", args...)
 	chpasswdCmd.Stdout = os.Stdout
 	chpasswdCmd.Stderr = os.Stderr
-	chpasswdCmd.Stdin = reader
-	chpasswdCmd.Start()
-	writer.Write(s)
-	writer.Close()
-	err := chpasswdCmd.Wait()
-	reader.Close()
-	if err != nil {
-		return err
-	}
-	return nil
-
+	chpasswdCmd.Stdin = strings.NewReader(fmt.Sprintf("root:%s\n", l.Data.RootPasswd))
+	return l.run(chpasswdCmd)
 }
 
 // parses sshd_config, writes authorized_keys file and restarts sshd service
@@ -314,24 +783,118 @@ func (l *Lift) sshdSetup() error {
 	if l.Data.SSHDConfig == nil {
 		return nil
 	}
-	if err := parseConfigFile("/etc/ssh/sshd_config", " ", l.getSSHDKVMap()); err != nil {
+	sshdConfig, err := l.target("/etc/ssh/sshd_config")
+	if err != nil {
+		return err
+	}
+	if err := parseConfigFile(sshdConfig, " ", l.getSSHDKVMap()); err != nil {
 		return err
 	}
 	if err := l.addSSHKeys(); err != nil {
 		return err
 	}
-	if err := doService("sshd", RESTART); err != nil {
+	if err := l.installHostKeys(); err != nil {
+		return err
+	}
+	if err := l.doService("sshd", RESTART); err != nil {
 		return err
 	}
 	return nil
 }
 
+// installs bonding support. ifupdown-ng has it built in, classic ifupdown
+// needs the bonding package.
+func (l *Lift) bondingSetup(ng bool) error {
+	if !ng {
+		l.log.Debug("apk add bonding")
+		if err := l.runCmd("apk", "add", "bonding"); err != nil {
+			return err
+		}
+	}
+	return l.runCmd("modprobe", "bonding")
+}
+
+// installs VLAN support: the vlan package and the 8021q kernel module
+func (l *Lift) vlanSetup() error {
+	l.log.Debug("apk add vlan")
+	if err := l.runCmd("apk", "add", "vlan"); err != nil {
+		return err
+	}
+	return l.runCmd("modprobe", "8021q")
+}
+
+// renders the interfaces_template (a local path or url) to the interfaces file
+func (l *Lift) installInterfacesTemplate() error {
+	src := l.Data.Network.InterfacesTemplate
+	var text []byte
+	var err error
+	if strings.Contains(src, "://") {
+		l.log.WithField("url", src).Debug("Downloading interfaces template")
+		text, err = l.downloadFile(src, nil)
+	} else {
+		text, err = l.readLocalFile(src)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read interfaces template %s: %w", src, err)
+	}
+	t, err := template.New("interfaces-template").Funcs(tplFuncMap).Parse(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid interfaces template %s: %v", src, err)
+	}
+	l.log.Debugf("Generating %s from %s", interfacesFile, src)
+	return l.installTemplate(*t, interfacesFile, 0644)
+}
+
+// disables IPv6 on all interfaces, now and on every boot (sysctl)
+func (l *Lift) disableIPv6() error {
+	l.log.Debugf("Disabling IPv6 (%s)", ipv6SysctlFile)
+	conf := "net.ipv6.conf.all.disable_ipv6 = 1\nnet.ipv6.conf.default.disable_ipv6 = 1\n"
+	dir, err := l.target(filepath.Dir(ipv6SysctlFile))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := l.writeFileAtomic(ipv6SysctlFile, []byte(conf), 0644, ""); err != nil {
+		return err
+	}
+	if err := l.runCmd("sysctl", "-p", ipv6SysctlFile); err != nil {
+		return fmt.Errorf("unable to disable IPv6: %v", err)
+	}
+	return l.doService("sysctl", ENABLE, bootRunlevel)
+}
+
 // call setup-dns Alpine setup script for configuring resolv.conf
 func (l *Lift) dnsSetup() error {
-	if l.Data.Network.ResolvConf != nil {
+	if l.Data.Network != nil && l.Data.Network.ResolvConf != nil && l.Data.Network.ResolvConf.Direct {
+		l.log.Debugf("Generating %s", resolvConfFile)
+		return l.installTemplate(*resolvConf, resolvConfFile, 0644)
+	}
+	if l.Data.Network != nil && l.Data.Network.ResolvConf != nil {
 		if l.Data.Network.ResolvConf.NameServers != nil && len(l.Data.Network.ResolvConf.NameServers) > 0 {
-			cmd := exec.Command("setup-dns", "-d", l.Data.Network.ResolvConf.Domain, "-n", strings.Join(l.Data.Network.ResolvConf.NameServers, " "))
-			if err := cmd.Run(); err != nil {
+			if err := l.runCmd("setup-dns", "-d", l.Data.Network.DNSDomain(), "-n", strings.Join(l.Data.Network.ResolvConf.NameServers, " ")); err != nil {
+				return err
+			}
+		}
+		// setup-dns only knows a single (search) domain
+		resolv, err := l.target(resolvConfFile)
+		if err != nil {
+			return err
+		}
+		search := l.Data.Network.ResolvConf.SearchDomains
+		if len(search) == 0 && l.Data.Network.DNSDomain() != "" {
+			// also when setup-dns didn't run (no nameservers)
+			search = []string{l.Data.Network.DNSDomain()}
+		}
+		if len(search) > 0 {
+			l.log.Debugf("Setting search domains in %s", resolvConfFile)
+			if err := setResolvConfLine(resolv, "search", search); err != nil {
+				return err
+			}
+		}
+		if len(l.Data.Network.ResolvConf.Options) > 0 {
+			if err := setResolvConfLine(resolv, "options", l.Data.Network.ResolvConf.Options); err != nil {
 				return err
 			}
 		}
@@ -341,60 +904,221 @@ func (l *Lift) dnsSetup() error {
 
 // call setup-ntp Alpine setup script for configuring NTP
 func (l *Lift) ntpSetup() error {
-	if l.Data.Network.NTP != nil {
+	if l.Data.Network != nil && l.Data.Network.NTP != nil {
 		if (l.Data.Network.NTP.Pools != nil && len(l.Data.Network.NTP.Pools) > 0) ||
 			(l.Data.Network.NTP.Servers != nil && len(l.Data.Network.NTP.Servers) > 0) {
-			cmd := exec.Command("setup-ntp", "-c", "chrony")
-			if err := cmd.Run(); err != nil {
+			impl, err := ntpImplementationFor(l.Data.Network.NTP.Implementation)
+			if err != nil {
 				return err
 			}
-			log.Debug("Generating chrony.conf")
-			chrony, err := generateFileFromTemplate(*chronyConf, l.Data)
-			if err != nil {
+			// setup-ntp starts the NTP daemon with the distro default pools, before
+			// our configuration is in place. Avoid that when defaults are disabled.
+			if l.Data.Network.NTP.DisableDefaults {
+				l.log.Debugf("apk add %s", impl.pkg)
+				if err := l.runCmd("apk", "add", impl.pkg); err != nil {
+					return err
+				}
+			} else {
+				if err := l.runCmd("setup-ntp", "-c", impl.setupName); err != nil {
+					return err
+				}
+			}
+			l.log.Debugf("Add %s service to default runlevel", impl.service)
+			if err := l.doService(impl.service, ENABLE, defaultRunlevel); err != nil {
 				return err
 			}
-			log.Debugf("Copying chrony.conf to %s", chronyConfFile)
-			cmd = exec.Command("mv", chrony, chronyConfFile)
-			if err := cmd.Run(); err != nil {
+			l.log.Debugf("Generating %s", impl.confFile)
+			if err := l.installTemplate(*impl.template, impl.confFile, 0644); err != nil {
 				return err
 			}
-			log.Debug("Restart Chrony")
-			_ = doService("chronyd", RESTART)
+			l.log.Debugf("Restart %s", impl.service)
+			if err := l.doService(impl.service, RESTART); err != nil {
+				if l.Data.Network.NTP.Strict {
+					return err
+				}
+				l.log.Errorf("Error restarting %s: %v", impl.service, err)
+			}
+			synced := false
+			if l.Data.Network.NTP.WaitForSync {
+				if err := l.waitForClockSync(); err != nil {
+					if l.Data.Network.NTP.Strict {
+						return err
+					}
+					l.log.Warn(err)
+				} else {
+					synced = true
+				}
+			}
+			if l.Data.Network.NTP.HWClockWrite {
+				l.syncHWClock(synced)
+			}
 		}
 	}
 	return nil
 }
 
+// waits (up to a minute) for chrony to synchronise the clock, and logs
+// its tracking report
+func (l *Lift) waitForClockSync() error {
+	l.log.Debug("Waiting for chrony to synchronise the clock")
+	if err := l.runCmd("chronyc", "waitsync", "6"); err != nil {
+		return fmt.Errorf("clock not synchronised: %w", err)
+	}
+	var out bytes.Buffer
+	cmd := l.command("chronyc", "tracking")
+	cmd.Stdout = &out
+	if err := l.run(cmd); err == nil {
+		l.log.Debugf("chronyc tracking:\n%s", out.String())
+	}
+	return nil
+}
+
+// waits for chrony to synchronise the clock (unless it already is) and
+// writes the system time to the hardware clock. Failures are logged, not fatal.
+func (l *Lift) syncHWClock(synced bool) {
+	if !synced {
+		l.log.Debug("Waiting for chrony to synchronise the clock")
+		if err := l.runCmd("chronyc", "waitsync", "12"); err != nil {
+			l.log.Warnf("Clock not synchronised, not writing hardware clock: %v", err)
+			return
+		}
+	}
+	l.log.Debug("Writing system time to hardware clock")
+	if err := l.runCmd("hwclock", "-w"); err != nil {
+		l.log.Warnf("Error writing hardware clock: %v", err)
+	}
+}
+
 // opens or creates authorized_keys file, and adds ssh keys
 // from alpine-data
 func (l *Lift) addSSHKeys() error {
-	if l.Data.SSHDConfig.AuthorizedKeys != nil && len(l.Data.SSHDConfig.AuthorizedKeys) > 0 {
-		file, err := openOrCreate("/root/.ssh/authorized_keys")
+	keys, err := l.authorizedKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		path, err := l.target(l.Data.SSHDConfig.authorizedKeysPath())
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		for _, key := range l.Data.SSHDConfig.AuthorizedKeys {
-			if _, err = file.WriteString(fmt.Sprintf("%s\n", key)); err != nil {
+		return appendAuthorizedKeys(path, keys)
+	}
+	return nil
+}
+
+// installs the configured host keys, and makes sure sshd_config refers to them.
+// Key contents are never logged.
+func (l *Lift) installHostKeys() error {
+	var directives []string
+	for _, k := range l.Data.SSHDConfig.HostKeys {
+		if k.PrivateKeyURL != "" && l.skipOffline(k.PrivateKeyURL, k.Type+" host key download") {
+			continue
+		}
+		private, err := l.hostKeyData(k.PrivateKey, k.PrivateKeyURL, "private")
+		if err != nil {
+			return err
+		}
+		l.log.WithField("type", k.Type).Debugf("Installing %s", k.path())
+		if err = l.writeFileAtomic(k.path(), private, 0600, ""); err != nil {
+			return err
+		}
+		public, err := l.hostKeyData(k.PublicKey, k.PublicKeyURL, "public")
+		if err != nil {
+			return err
+		}
+		if len(public) > 0 {
+			if err = l.writeFileAtomic(k.path()+".pub", public, 0644, ""); err != nil {
 				return err
 			}
 		}
+		directives = append(directives, "HostKey "+k.path())
 	}
-	return nil
+	if len(directives) == 0 {
+		return nil
+	}
+	sshdConfig, err := l.target("/etc/ssh/sshd_config")
+	if err != nil {
+		return err
+	}
+	return addConfigLines(sshdConfig, directives)
+}
+
+// returns the inline host key data, or downloads it from url
+func (l *Lift) hostKeyData(data, url, what string) ([]byte, error) {
+	if url != "" && l.skipOffline(url, what+" host key download") {
+		return nil, nil
+	}
+	if url == "" {
+		if data != "" && !strings.HasSuffix(data, "\n") {
+			data += "\n"
+		}
+		return []byte(data), nil
+	}
+	l.log.WithField("url", url).Debugf("Downloading %s host key", what)
+	b, err := l.downloadFile(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s host key from %s: %w", what, url, err)
+	}
+	return b, nil
+}
+
+// returns the inline authorized keys merged with the keys downloaded
+// from the authorized keys url, without duplicates
+func (l *Lift) authorizedKeys() ([]string, error) {
+	keys := append([]string{}, l.Data.SSHDConfig.AuthorizedKeys...)
+	if url := l.Data.SSHDConfig.AuthorizedKeysURL; url != "" && !l.skipOffline(url, "authorized keys download") {
+		l.log.WithField("url", url).Debug("Downloading authorized keys")
+		data, err := l.downloadFile(url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to download authorized keys from %s: %w", url, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if !isSSHPublicKey(line) {
+				l.log.WithField("url", url).Warnf("Ignoring invalid authorized key: %.40s", line)
+				continue
+			}
+			keys = append(keys, line)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var unique []string
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique, nil
 }
 
 // downloads drpcli and installs it as a service
 func (l *Lift) drpSetup() error {
+	if l.Data.DRP == nil || !l.Data.DRP.InstallRunner {
+		l.log.Debug("No dr-provision runner configured")
+		return nil
+	}
+
 	// First download drpcli
 	if _, err := os.Stat(drpcliBin); os.IsNotExist(err) {
 		url := fmt.Sprintf("%s/drpcli.amd64.linux", l.Data.DRP.AssetsURL)
-		log.WithField("url", url).Debug("Downloading drpcli")
-		drpcli, err := downloadFile(url, nil)
+		if l.skipOffline(url, "dr-provision runner setup") {
+			return nil
+		}
+		l.log.WithField("url", url).Debug("Downloading drpcli")
+		drpcli, err := l.downloadFile(url, nil)
 		if err != nil {
 			return err
 		}
-		log.Debugf("Saving drpcli to %s", drpcliBin)
-		err = ioutil.WriteFile(drpcliBin, drpcli, 0755)
+		if err = verifySHA256(drpcli, l.Data.DRP.DRPCLISHA256, url); err != nil {
+			return err
+		}
+		l.log.Debugf("Saving drpcli to %s", drpcliBin)
+		err = l.writeFileAtomic(drpcliBin, drpcli, 0755, "")
 		if err != nil {
 			return err
 		}
@@ -402,33 +1126,19 @@ func (l *Lift) drpSetup() error {
 
 	// then check RC file
 	if _, err := os.Stat(drpcliRCFile); os.IsNotExist(err) {
-		log.Debug("Generating drpcli rc service file")
-		rcfile, err := generateFileFromTemplate(*drpcliInit, l.Data)
-		if err != nil {
-			return err
-		}
-		log.Debugf("Copying service file to %s", drpcliRCFile)
-		cmd := exec.Command("mv", rcfile, drpcliRCFile)
-		err = cmd.Run()
-		if err != nil {
-			return err
-		}
-		log.Debug("Setting execute permission")
-		cmd = exec.Command("chmod", "+x", drpcliRCFile)
-		err = cmd.Run()
-		if err != nil {
-			return err
-		}
-		log.Debug("Add drpcli service to default runlevel")
-		cmd = exec.Command("rc-update", "add", "drpcli")
-		err = cmd.Run()
+		l.log.Debugf("Generating drpcli rc service file %s", drpcliRCFile)
+		err := l.installTemplate(*drpcliInit, drpcliRCFile, 0755)
 		if err != nil {
 			return err
 		}
 	}
+	l.log.Debug("Add drpcli service to default runlevel")
+	if err := l.doService("drpcli", ENABLE, defaultRunlevel); err != nil {
+		return err
+	}
 
-	log.Info("Starting dr-provision runner")
-	_ = doService("drpcli", START)
+	l.log.Info("Starting dr-provision runner")
+	_ = l.doService("drpcli", START)
 	return nil
 }
 
@@ -436,58 +1146,89 @@ func (l *Lift) setupAPK() error {
 	if l.Data.Packages == nil {
 		return nil
 	}
-	rfile, err := generateFileFromTemplate(*repoFile, l.Data.Packages.Repositories)
-	if err != nil {
+	l.log.Debug("Setting up repositories")
+	if err := l.expandRepositories(); err != nil {
 		return err
 	}
-	log.Debug("Setting up repositories")
-	cmd := exec.Command("mv", rfile, "/etc/apk/repositories")
-	err = cmd.Run()
+	l.checkMirrors()
+	err := l.installTemplate(*repoFile, apkRepositoriesFile, 0644)
 	if err != nil {
 		return err
 	}
-	if l.Data.Packages.Update {
-		log.Debug("Executing apk update")
-		cmd := exec.Command("apk", "update")
-		err = cmd.Run()
+	if dir := l.Data.Packages.CacheDir; dir != "" {
+		l.log.WithField("dir", dir).Debug("Setting up apk cache")
+		cacheDir, err := l.target(dir)
 		if err != nil {
 			return err
 		}
+		if err = os.MkdirAll(cacheDir, 0755); err != nil {
+			return err
+		}
+		if err = l.runCmd("setup-apkcache", dir); err != nil {
+			return err
+		}
+	}
+	if l.Data.Packages.Update {
+		l.log.Debug("Executing apk update")
+		if err = l.apkUpdate(); err != nil {
+			return err
+		}
 	}
 	if l.Data.Packages.Upgrade {
-		log.Debug("Executing apk upgrade")
-		cmd := exec.Command("apk", "upgrade")
-		err = cmd.Run()
-		if err != nil {
+		l.log.Debug("Executing apk upgrade")
+		if err = l.apkUpgrade(); err != nil {
 			return err
 		}
 	}
 	for _, p := range l.Data.Packages.Uninstall {
-		log.WithField("package", p).Debug("Executing apk del")
-		cmd := exec.Command("apk", "del", p)
-		err = cmd.Run()
+		l.log.WithField("package", p).Debug("Executing apk del")
+		cmd := l.command("apk", "del", p)
+		err = l.run(cmd)
 		if err != nil {
 			return err
 		}
 	}
 	for _, p := range l.Data.Packages.Install {
-		log.WithField("package", p).Debug("Executing apk add")
-		cmd := exec.Command("apk", "add", p)
-		err = cmd.Run()
+		l.log.WithField("package", p.apkName()).Debug("Executing apk add")
+		cmd := l.command("apk", "add", p.apkName())
+		err = l.run(cmd)
 		if err != nil {
+			if p.Version != "" {
+				return fmt.Errorf("unable to install %s version %s: %w", p.Name, p.Version, err)
+			}
 			return err
 		}
+		if err = l.postInstall(p); err != nil {
+			if !l.Data.ContinueOnError {
+				return err
+			}
+			l.log.Error(err)
+		}
+	}
+	return nil
+}
+
+// runs the post install commands of a package through sh
+func (l *Lift) postInstall(p Package) error {
+	for _, c := range p.PostInstall {
+		l.log.WithField("package", p.Name).Debugf("exec post install: sh -c \"%s\"", c)
+		cmd := l.command("sh", "-c", c)
+		cmd.Env = os.Environ()
+		if err := l.run(cmd); err != nil {
+			return fmt.Errorf("post install of %s failed (%s): %v", p.Name, c, err)
+		}
 	}
 	return nil
 }
 
 func (l *Lift) setMOTD() error {
 	if l.Data.MOTD != "" {
-		err := os.Truncate("/etc/motd", 0)
+		// minimal images may not have a motd yet
+		path, err := l.target("/etc/motd")
 		if err != nil {
 			return err
 		}
-		file, err := os.OpenFile("/etc/motd", os.O_RDWR|os.O_EXCL, 0600)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			return err
 		}
@@ -501,36 +1242,139 @@ func (l *Lift) setMOTD() error {
 
 func (l *Lift) createFiles() error {
 	for _, wf := range l.Data.WriteFiles {
-		var data []byte
+		if err := l.createFile(wf); err != nil {
+			if !l.Data.ContinueOnError {
+				return err
+			}
+			l.log.Error(err)
+		}
+	}
+	return nil
+}
+
+// creates a single file from write_files
+func (l *Lift) createFile(wf WriteFile) error {
+	var data []byte
 
-		perm, err := strconv.ParseUint(wf.Permissions, 8, 32)
+	perm, err := wf.mode()
+	if err != nil {
+		return err
+	}
+	if !wf.overwrite() {
+		// check the path that is written to (the copy in dry-run mode)
+		path, err := l.target(wf.Path)
 		if err != nil {
-			return fmt.Errorf("Error reading permissions: %s", err)
+			return err
 		}
-		log.Infof("Creating %s", wf.Path)
-		err = os.MkdirAll(filepath.Dir(wf.Path), 0711)
-		if err != nil {
-			return fmt.Errorf("Error creating %s: %s", filepath.Dir(wf.Path), err)
+		if _, err := os.Stat(path); err == nil {
+			l.log.Infof("Preserving existing %s", wf.Path)
+			return nil
 		}
-		if wf.Content != "" {
-			data = []byte(wf.Content)
+	}
+	if wf.ContentURL != "" && l.skipOffline(wf.ContentURL, "writing "+wf.Path) {
+		return nil
+	}
+	l.log.Infof("Creating %s", wf.Path)
+	dirPerm, err := wf.dirMode()
+	if err != nil {
+		return err
+	}
+	if err = l.mkdirs(filepath.Dir(wf.Path), dirPerm, wf.Owner); err != nil {
+		return fmt.Errorf("Error creating %s: %s", filepath.Dir(wf.Path), err)
+	}
+	if wf.Content != "" {
+		data = []byte(wf.Content)
 
-		} else if wf.ContentURL != "" {
-			if data, err = downloadFile(wf.ContentURL, nil); err != nil {
-				return err
-			}
+	} else if wf.ContentURL != "" {
+		if data, err = l.downloadFile(wf.ContentURL, nil); err != nil {
+			return err
+		}
+	} else if wf.ContentPath != "" {
+		if data, err = l.readLocalFile(wf.ContentPath); err != nil {
+			return fmt.Errorf("Error reading %s: %s", wf.ContentPath, err)
 		}
-		err = ioutil.WriteFile(wf.Path, data, os.FileMode(perm))
+	}
+	// the checksum covers the content as fetched, before it is decoded
+	if err = verifySHA256(data, wf.SHA256, wf.Path); err != nil {
+		return err
+	}
+	if data, err = l.decodeContent(wf, data); err != nil {
+		return err
+	}
+	if wf.Template {
+		t, err := parseContentTemplate(wf.Path, string(data))
 		if err != nil {
-			log.Debugf("error writing file: %s", err)
+			return err
 		}
-		if wf.Owner != "" {
-			cmd := exec.Command("chown", wf.Owner, wf.Path)
-			err = cmd.Run()
-			if err != nil {
-				return err
+		var buf bytes.Buffer
+		if err = t.Execute(&buf, l.templateContext()); err != nil {
+			return fmt.Errorf("Error rendering %s: %s", wf.Path, err)
+		}
+		data = buf.Bytes()
+	}
+	// the path that is written to (the copy in dry-run mode)
+	path, err := l.target(wf.Path)
+	if err != nil {
+		return err
+	}
+	immutable := wf.Immutable && l.supportsImmutable(filepath.Dir(path))
+	if immutable {
+		if _, err := os.Stat(path); err == nil {
+			// the file can't be replaced while it is immutable
+			if err := l.runCmd("chattr", "-i", path); err != nil {
+				return fmt.Errorf("Error making %s mutable: %s", wf.Path, err)
 			}
 		}
 	}
+	if wf.Append {
+		err = l.appendFile(wf.Path, data, perm, wf.Owner)
+	} else {
+		err = l.writeFileAtomic(wf.Path, data, perm, wf.Owner)
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing %s: %s", wf.Path, err)
+	}
+	if immutable {
+		if err := l.runCmd("chattr", "+i", path); err != nil {
+			return fmt.Errorf("Error making %s immutable: %s", wf.Path, err)
+		}
+	}
 	return nil
 }
+
+// decodes the content of a write_files entry according to its encoding
+func (l *Lift) decodeContent(wf WriteFile, data []byte) ([]byte, error) {
+	enc := wf.encoding()
+	if enc == "base64" || enc == "gzip+base64" {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding base64 content of %s: %s", wf.Path, err)
+		}
+		data = decoded
+	}
+	if enc == "gzip" || enc == "gzip+base64" {
+		decompressed, err := l.gunzip(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error decompressing %s: invalid or corrupt gzip content: %s", wf.Path, err)
+		}
+		data = decompressed
+	}
+	return data, nil
+}
+
+// returns true when files in dir can be made immutable with chattr,
+// installing chattr when needed
+func (l *Lift) supportsImmutable(dir string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil || fs.Type != ext4SuperMagic {
+		l.log.Warnf("Filesystem of %s doesn't support chattr, not making files immutable", dir)
+		return false
+	}
+	if _, err := exec.LookPath("chattr"); err != nil {
+		if err := l.runCmd("apk", "add", "e2fsprogs-extra"); err != nil {
+			l.log.Warnf("Unable to install chattr, not making files immutable: %v", err)
+			return false
+		}
+	}
+	return true
+}
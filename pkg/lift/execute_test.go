@@ -0,0 +1,63 @@
+package lift
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// returns a dry-run lift writing its files to an empty temp dir
+func newDryRunLift(t *testing.T, data *AlpineData) *Lift {
+	dir, err := ioutil.TempDir("", "lift-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l := NewLift(data, WithDryRun(true))
+	l.dryRunDir = dir
+	return l
+}
+
+func TestSetMOTDMissingFile(t *testing.T) {
+	d := InitAlpineData()
+	d.MOTD = "Welcome to lift"
+	l := newDryRunLift(t, d)
+	motd := filepath.Join(l.dryRunDir, "etc", "motd")
+
+	if err := l.setMOTD(); err != nil {
+		t.Fatalf("setMOTD: %v", err)
+	}
+	b, err := ioutil.ReadFile(motd)
+	if err != nil {
+		t.Fatalf("motd not created: %v", err)
+	}
+	if string(b) != d.MOTD+"\n" {
+		t.Errorf("motd is %q, expected %q", b, d.MOTD+"\n")
+	}
+}
+
+func TestSetMOTDTruncatesExisting(t *testing.T) {
+	d := InitAlpineData()
+	d.MOTD = "short"
+	l := newDryRunLift(t, d)
+	motd := filepath.Join(l.dryRunDir, "etc", "motd")
+	if err := os.MkdirAll(filepath.Dir(motd), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(motd, []byte(strings.Repeat("a much longer motd\n", 10)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.setMOTD(); err != nil {
+		t.Fatalf("setMOTD: %v", err)
+	}
+	b, err := ioutil.ReadFile(motd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != d.MOTD+"\n" {
+		t.Errorf("motd is %q, expected %q", b, d.MOTD+"\n")
+	}
+}
@@ -0,0 +1,61 @@
+package lift
+
+import (
+	"strconv"
+)
+
+const fail2banJailFile = "/etc/fail2ban/jail.local"
+
+// returns the jails to configure: the configured ones, plus an sshd jail
+// when none was configured explicitly
+func (f *Fail2BanConfig) jails(sshPort string) []Fail2BanJail {
+	for _, j := range f.Jails {
+		if j.Name == "sshd" {
+			return f.Jails
+		}
+	}
+	sshd := Fail2BanJail{
+		Name:    "sshd",
+		Port:    sshPort,
+		LogPath: "/var/log/messages",
+	}
+	return append([]Fail2BanJail{sshd}, f.Jails...)
+}
+
+// Fail2BanAction returns the fail2ban ban action matching the firewall backend
+func (c *TemplateContext) Fail2BanAction() string {
+	if c.Firewall != nil && c.Firewall.backend() == "nftables" {
+		return "nftables-multiport"
+	}
+	return "iptables-multiport"
+}
+
+// Fail2BanJails returns the jails for jail.local
+func (c *TemplateContext) Fail2BanJails() []Fail2BanJail {
+	port := "ssh"
+	if c.SSHDConfig != nil && c.SSHDConfig.Port != 0 {
+		port = strconv.Itoa(c.SSHDConfig.Port)
+	}
+	return c.Fail2Ban.jails(port)
+}
+
+// installs fail2ban, writes jail.local and enables the service
+func (l *Lift) fail2banSetup() error {
+	if l.Data.Fail2Ban == nil || !l.Data.Fail2Ban.Enable {
+		l.log.Debug("No fail2ban configured")
+		return nil
+	}
+
+	l.log.Debug("apk add fail2ban")
+	if err := l.runCmd("apk", "add", "fail2ban"); err != nil {
+		return err
+	}
+	l.log.Debugf("Generating %s", fail2banJailFile)
+	if err := l.installTemplate(*fail2banJail, fail2banJailFile, 0644); err != nil {
+		return err
+	}
+	if err := l.doService("fail2ban", ENABLE, defaultRunlevel); err != nil {
+		return err
+	}
+	return l.doService("fail2ban", RESTART)
+}
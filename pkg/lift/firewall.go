@@ -0,0 +1,69 @@
+package lift
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	iptablesRulesFile  = "/etc/iptables/rules-save"
+	ip6tablesRulesFile = "/etc/iptables/rules6-save"
+	nftablesRulesFile  = "/etc/nftables.nft"
+)
+
+// returns the firewall backend to use: the configured one, otherwise the one
+// that is already installed, falling back to iptables
+func (f *FirewallConfig) backend() string {
+	if f.Backend != "" {
+		return strings.ToLower(f.Backend)
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		return "nftables"
+	}
+	return "iptables"
+}
+
+// installs the firewall, renders the ruleset for the chosen backend and
+// enables the matching service
+func (l *Lift) firewallSetup() error {
+	if l.Data.Firewall == nil {
+		l.log.Debug("No firewall configured")
+		return nil
+	}
+
+	backend := l.Data.Firewall.backend()
+	l.log.WithField("backend", backend).Debug("Setting up firewall")
+	switch backend {
+	case "iptables":
+		if err := l.runCmd("apk", "add", "iptables"); err != nil {
+			return err
+		}
+		if err := l.installTemplate(*iptablesRules, iptablesRulesFile, 0600); err != nil {
+			return err
+		}
+		if err := l.installTemplate(*ip6tablesRules, ip6tablesRulesFile, 0600); err != nil {
+			return err
+		}
+		if err := l.doService("ip6tables", ENABLE, defaultRunlevel); err != nil {
+			return err
+		}
+		if err := l.doService("ip6tables", RESTART); err != nil {
+			return err
+		}
+	case "nftables":
+		if err := l.runCmd("apk", "add", "nftables"); err != nil {
+			return err
+		}
+		if err := l.installTemplate(*nftablesRules, nftablesRulesFile, 0600); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("firewall: unknown backend %q", backend)
+	}
+
+	if err := l.doService(backend, ENABLE, defaultRunlevel); err != nil {
+		return err
+	}
+	return l.doService(backend, RESTART)
+}
@@ -0,0 +1,52 @@
+package lift
+
+import (
+	"strings"
+)
+
+// creates the LVM volume group and logical volumes, skipping the ones that
+// already exist. The logical volumes are available as /dev/<vg>/<lv>.
+func (l *Lift) lvmSetup() error {
+	if l.Data.LVM == nil {
+		l.log.Debug("No LVM configured")
+		return nil
+	}
+	vg := l.Data.LVM.VolumeGroup
+	if err := l.runCmd("apk", "add", "lvm2"); err != nil {
+		return err
+	}
+
+	if l.exists("vgs", vg) {
+		l.log.WithField("vg", vg).Info("Volume group already exists")
+	} else {
+		for _, pv := range l.Data.LVM.PhysicalVolumes {
+			if l.exists("pvs", pv) {
+				continue
+			}
+			l.log.Debugf("Creating physical volume %s", pv)
+			if err := l.runCmd("pvcreate", pv); err != nil {
+				return err
+			}
+		}
+		l.log.WithField("vg", vg).Infof("Creating volume group from %v", l.Data.LVM.PhysicalVolumes)
+		if err := l.runCmd("vgcreate", append([]string{vg}, l.Data.LVM.PhysicalVolumes...)...); err != nil {
+			return err
+		}
+	}
+
+	for _, lv := range l.Data.LVM.LogicalVolumes {
+		if l.exists("lvs", vg+"/"+lv.Name) {
+			l.log.WithField("vg", vg).Infof("Logical volume %s already exists", lv.Name)
+			continue
+		}
+		sizeOpt := "-L"
+		if strings.Contains(lv.Size, "%") {
+			sizeOpt = "-l"
+		}
+		l.log.WithField("vg", vg).Infof("Creating logical volume %s (%s)", lv.Name, lv.Size)
+		if err := l.runCmd("lvcreate", "-n", lv.Name, sizeOpt, lv.Size, vg); err != nil {
+			return err
+		}
+	}
+	return l.doService("lvm", ENABLE, bootRunlevel)
+}
@@ -1,6 +1,8 @@
 package lift
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +10,8 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
@@ -18,174 +22,479 @@ type Lift struct {
 	DataURL        string
 	RequestHeaders http.Header
 	Data           *AlpineData
+
+	fetchData  bool
+	silent     bool
+	dryRun     bool
+	dryRunDir  string // where files are written in dry-run mode
+	offline    bool
+	executor   Executor
+	log        *log.Logger
+	onlyStages []string
+	skipStages []string
+	statusFile string
+	metricsURL string
+	status     Status
+	statusMu   sync.Mutex
+	statusAddr string
+	build      *BuildInfo
+	confirm    ConfirmFunc
+
+	ctx       context.Context
+	cleanups  []*cleanup
+	deadlines sync.Map // *exec.Cmd -> *cmdDeadline
+}
+
+// New returns a new Lift instance with initial configuration, that
+// downloads its alpine-data from dataURL when started
+func New(dataURL string, requestHeaders http.Header, opts ...Option) (*Lift, error) {
+	l := NewLift(nil, opts...)
+	l.DataURL = dataURL
+	l.RequestHeaders = requestHeaders
+	return l, nil
+}
+
+// NewLift returns a new Lift instance that applies the given alpine-data.
+// When data is nil, the alpine-data is downloaded from the URL set in the
+// kernel boot parameters (or DataURL) instead. Use InitAlpineData to start
+// from the defaults.
+func NewLift(data *AlpineData, opts ...Option) *Lift {
+	l := &Lift{
+		Data:     data,
+		executor: execExecutor{},
+		log:      log.StandardLogger(),
+	}
+	if data == nil {
+		l.Data = InitAlpineData()
+		l.fetchData = true
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
 }
 
-// New returns a new Lift instance with initial configuration
-func New(dataURL string, requestHeaders http.Header) (*Lift, error) {
-	return &Lift{
-		DataURL:        dataURL,
-		RequestHeaders: requestHeaders,
-		Data:           InitAlpineData(),
-	}, nil
+// stage is a single named step in the lift sequence
+type stage struct {
+	name string
+	desc string
+	run  func() error
 }
 
-// Start contains the main program loop
+// cmdDeadline is the timeout context of a command created by command
+type cmdDeadline struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+// cleanup is a function that restores system state when lift is interrupted
+// or fails halfway through a stage
+type cleanup struct {
+	desc string
+	fn   func() error
+}
+
+// returns the ordered list of stages lift executes
+func (l *Lift) stages() []stage {
+	return []stage{
+		{"bootcmd", "Executing early commands", l.bootCommands},
+		{"rootpasswd", "Set root password", l.rootPasswdSetup},
+		{"raid", "Setup RAID arrays", l.raidSetup},
+		{"lvm", "Setup LVM volumes", l.lvmSetup},
+		{"scratchdisk", "Executing setup-disk", l.scratchDiskSetup},
+		{"swap", "Disabling swap", l.swapSetup},
+		{"disks", "Add additional disks", l.diskSetup},
+		{"diskspace", "Checking free disk space", l.diskSpaceCheck},
+		{"hostname", "Setting Hostname", l.setHostname},
+		{"network", "Setup Network Interfaces", l.networkSetup},
+		{"dns", "Setup DNS", l.dnsSetup},
+		{"proxy", "Setup Up Network Proxy", l.proxySetup},
+		{"ntp", "Setup NTP", l.ntpSetup},
+		{"apk", "Setup APK and Packages", l.setupAPK},
+		// needs the network and repositories for installing tzdata
+		{"timezone", "Setting timezone", l.timezoneSetup},
+		{"setupscripts", "Running setup scripts", l.setupScriptsSetup},
+		{"sshd", "Setup SSHD configuration", l.sshdSetup},
+		{"firewall", "Setup firewall", l.firewallSetup},
+		{"fail2ban", "Setup fail2ban", l.fail2banSetup},
+		{"openvpn", "Setup OpenVPN clients", l.openvpnSetup},
+		{"groups", "Creating groups", l.groupsSetup},
+		{"users", "Creating Users", l.usersSetup},
+		{"drp", "Installing dr-provision runner", l.drpSetup},
+		{"mta", "Setup MTA", l.mtaSetup},
+		{"files", "Writing files", l.createFiles},
+		{"services", "Starting services", l.servicesSetup},
+		{"console", "Setup console", l.consoleSetup},
+		{"motd", "Setting MOTD", l.setMOTD},
+		{"release", "Writing lift release file", l.writeRelease},
+		{"runcmd", "Executing post-install commands", l.runCommands},
+		{"unlift", "Removing lift binary from the system", l.unLift},
+	}
+}
+
+// Start runs lift without the possibility to interrupt it
 func (l *Lift) Start() error {
+	return l.Run(context.Background())
+}
+
+// Run contains the main program loop. When ctx is cancelled, the running
+// stage is interrupted, registered cleanups are executed and ctx.Err()
+// is returned.
+func (l *Lift) Run(ctx context.Context) (err error) {
+	l.ctx = ctx
+	l.status = Status{Started: time.Now(), Build: l.build}
+	stopStatusServer := func() {}
+	defer func() {
+		if err != nil {
+			l.runCleanups()
+		}
+		l.finishStatus(err)
+		stopStatusServer()
+	}()
+
+	if err = l.validateStages(); err != nil {
+		return &StageError{Category: CategoryValidation, Err: err}
+	}
+	if l.statusAddr != "" {
+		if stopStatusServer, err = l.serveStatus(); err != nil {
+			stopStatusServer = func() {}
+			return err
+		}
+	}
+
 	// If alpine-lift-silent kernel boot param is set, silence all logging/output
 	if s, err := getKernelBootParam("alpine-lift-silent"); err == nil && s != "" {
-		log.SetOutput(ioutil.Discard)
-		silent = true
+		l.silent = true
+	}
+	if l.silent {
+		l.log.SetOutput(ioutil.Discard)
 	}
 
 	// If alpine-lift-debug-log kernel boot param is set, enable debug logging/output
 	if s, err := getKernelBootParam("alpine-lift-debug-log"); err == nil && s != "" {
-		log.SetLevel(log.DebugLevel)
+		l.log.SetLevel(log.DebugLevel)
 	}
 
-	log.Info("Lift starting...")
-	// If url not provided, read it from the kernel boot parameters
-	if l.DataURL == "" {
-		var err error
-		if l.DataURL, err = getKernelBootParam("alpine-data"); err != nil {
+	l.log.Info("Lift starting...")
+	if l.fetchData {
+		if err = l.fetchAlpineData(); err != nil {
+			return stageError("", err)
+		}
+	}
+	if err = l.Data.Validate(); err != nil {
+		return &StageError{Category: CategoryValidation, Err: err}
+	}
+	if l.dryRun {
+		for _, p := range l.Plan() {
+			l.log.WithField("stage", p.Name).WithField("run", p.Run).WithField("reason", p.Reason).Info("dry-run: plan")
+		}
+	}
+
+	var failed StageErrors
+	for _, s := range l.stages() {
+		if err = ctx.Err(); err != nil {
 			return err
 		}
-		if l.DataURL == "" {
-			return errors.New("alpine-data URL not set")
+		if reason := l.skipReason(s.name); reason != "" {
+			l.log.WithField("stage", s.name).WithField("reason", reason).Debug("Skipping stage")
+			l.recordStage(s.name, true, 0, nil)
+			continue
+		}
+		if err = l.confirmStage(s.name); err != nil {
+			return err
+		}
+		l.log.Info(s.desc)
+		start := time.Now()
+		l.startStage(s.name)
+		err = l.runStage(s)
+		l.recordStage(s.name, false, time.Since(start), err)
+		if err != nil {
+			// report the interruption rather than the killed process
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			se := stageError(s.name, err)
+			if !l.Data.ContinueOnError {
+				return se
+			}
+			l.log.WithField("stage", s.name).WithField("category", se.Category).Errorf("Stage failed, continuing: %v", err)
+			failed = append(failed, se)
+			err = nil
 		}
 	}
-	log.WithField("url", l.DataURL).Info("downloading alpine-data file")
-	data, err := downloadFile(l.DataURL, l.RequestHeaders)
-	if err != nil {
-		return err
+	if len(failed) > 0 {
+		return failed
 	}
 
-	if err = yaml.Unmarshal(data, l.Data); err != nil {
-		return err
-	}
+	l.log.Info("Lift successfully completed")
+	return nil
+}
 
-	log.Info("Set root password")
-	if err = l.rootPasswdSetup(); err != nil {
+// runs a stage, surrounded by its pre and post hooks
+func (l *Lift) runStage(s stage) error {
+	hook := l.Data.StageHooks[s.name]
+	if err := l.runHooks(s.name, "pre", hook.Pre); err != nil {
 		return err
 	}
-
-	log.Info("Executing setup-disk")
-	if err = l.scratchDiskSetup(); err != nil {
+	if err := s.run(); err != nil {
 		return err
 	}
+	return l.runHooks(s.name, "post", hook.Post)
+}
 
-	log.Info("Add additional disks")
-	if err = l.diskSetup(); err != nil {
-		return err
+// runs hook commands through sh, stopping at the first one failing
+func (l *Lift) runHooks(stage, when string, commands []string) error {
+	for _, c := range commands {
+		l.log.WithField("stage", stage).Debugf("exec %s hook: sh -c \"%s\"", when, c)
+		cmd := l.command("sh", "-c", c)
+		cmd.Env = os.Environ()
+		if err := l.run(cmd); err != nil {
+			return fmt.Errorf("%s hook of stage %s failed: %v", when, stage, err)
+		}
 	}
+	return nil
+}
 
-	if l.Data.Network != nil {
-		log.Info("Setting Hostname")
-		if err = l.setHostname(); err != nil {
+// downloads and parses the alpine-data file
+func (l *Lift) fetchAlpineData() error {
+	var err error
+	// If url not provided, read it from the kernel boot parameters
+	if l.DataURL == "" {
+		if l.DataURL, err = getKernelBootParam("alpine-data"); err != nil {
 			return err
 		}
-
-		log.Info("Setup Network Interfaces")
-		if err = l.networkSetup(); err != nil {
-			return err
+		if l.DataURL == "" {
+			return errors.New("alpine-data URL not set")
 		}
-
-		log.Info("Setup DNS")
-		if err = l.dnsSetup(); err != nil {
+	}
+	var data []byte
+	if l.DataURL == stdinURL {
+		l.log.Info("reading alpine-data from stdin")
+		if data, err = l.readStdin(); err != nil {
 			return err
 		}
-
-		log.Info("Setup Up Network Proxy")
-		if err = l.proxySetup(); err != nil {
-			return err
+	} else {
+		if l.offline && !isLocalURL(l.DataURL) {
+			return fmt.Errorf("can't download alpine-data from %s in offline mode, use a file:// url", l.DataURL)
 		}
-
-		log.Info("Setup NTP")
-		if err = l.ntpSetup(); err != nil {
+		l.log.WithField("url", l.DataURL).Info("downloading alpine-data file")
+		if data, err = l.downloadFile(l.DataURL, l.RequestHeaders); err != nil {
 			return err
 		}
 	}
-
-	log.Info("Setup APK and Packages")
-	if err = l.setupAPK(); err != nil {
-		return err
+	if isGzip(data) {
+		l.log.Debug("alpine-data is gzip compressed")
+		if data, err = l.gunzip(data); err != nil {
+			return fmt.Errorf("unable to decompress alpine-data: %v", err)
+		}
 	}
-
-	log.Info("Setup SSHD configuration")
-	if err = l.sshdSetup(); err != nil {
-		return err
+	if err = yaml.Unmarshal(data, l.Data); err != nil {
+		return &StageError{Category: CategoryValidation, Err: fmt.Errorf("invalid alpine-data: %v", err)}
 	}
+	return nil
+}
 
-	log.Info("Creating groups")
-	for _, grp := range l.Data.Groups {
-		cmd := exec.Command("addgroup", grp)
-		log.Infof("Creating group %s", grp)
-		if err = cmd.Run(); err != nil {
-			log.Debugf("Error creating group %s: %v", grp, err)
+// registers a cleanup that is executed (in reverse order of registration)
+// when lift fails or is interrupted. The returned release function removes
+// the cleanup again, once the stage restored the state by itself.
+func (l *Lift) registerCleanup(desc string, fn func() error) (release func()) {
+	c := &cleanup{desc: desc, fn: fn}
+	l.cleanups = append(l.cleanups, c)
+	return func() {
+		for i, rc := range l.cleanups {
+			if rc == c {
+				l.cleanups = append(l.cleanups[:i], l.cleanups[i+1:]...)
+				return
+			}
 		}
 	}
+}
 
-	log.Info("Creating Users")
-	for _, user := range l.Data.Users {
-		log.Infof("Creating user %s", user.Name)
-		if err = createOSUser(user); err != nil {
-			log.Debugf("Error creating user %s: %v", user.Name, err)
+// executes all registered cleanups, last registered first
+func (l *Lift) runCleanups() {
+	// cleanups must still be able to run commands when lift was interrupted
+	l.ctx = context.Background()
+	for i := len(l.cleanups) - 1; i >= 0; i-- {
+		c := l.cleanups[i]
+		l.log.WithField("cleanup", c.desc).Warn("Running cleanup")
+		if err := c.fn(); err != nil {
+			l.log.WithField("cleanup", c.desc).Errorf("Cleanup failed: %v", err)
 		}
 	}
+	l.cleanups = nil
+}
 
-	if l.Data.DRP != nil && l.Data.DRP.InstallRunner {
-		log.Info("Installing dr-provision runner")
-		if err = l.drpSetup(); err != nil {
-			return err
-		}
+// returns a command that is killed when lift is interrupted
+func (l *Lift) command(name string, args ...string) *exec.Cmd {
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := l.commandTimeout()
+	if timeout <= 0 {
+		return exec.CommandContext(ctx, name, args...)
 	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	cmd := exec.CommandContext(ctx, name, args...)
+	l.deadlines.Store(cmd, &cmdDeadline{ctx, cancel, timeout})
+	return cmd
+}
 
-	log.Info("Setup MTA")
-	if err = l.mtaSetup(); err != nil {
-		return err
+// returns the timeout of commands in the running stage: its command_timeouts
+// entry, or command_timeout. 0 means no timeout.
+func (l *Lift) commandTimeout() time.Duration {
+	if l.Data == nil {
+		return 0
 	}
+	seconds := l.Data.CommandTimeout
+	if t, ok := l.Data.CommandTimeouts[l.Status().Current]; ok {
+		seconds = t
+	}
+	return time.Duration(seconds) * time.Second
+}
 
-	log.Info("Writing files")
-	if err = l.createFiles(); err != nil {
-		return err
+// waits for d, or until lift is interrupted
+func (l *Lift) sleep(d time.Duration) error {
+	ctx := l.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	log.Info("Setting MOTD")
-	if err = l.setMOTD(); err != nil {
-		return err
+// runs a command through the configured executor. When the caller doesn't
+// handle stderr itself, it is captured and the error is annotated with the
+// command line and its output. A command that runs past its timeout is killed.
+func (l *Lift) run(cmd *exec.Cmd) error {
+	v, ok := l.deadlines.LoadAndDelete(cmd)
+	if !ok {
+		return l.runUntimed(cmd)
 	}
+	d := v.(*cmdDeadline)
+	defer d.cancel()
+	err := l.runUntimed(cmd)
+	if err != nil && d.ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s: %w", d.timeout, err)
+	}
+	return err
+}
 
-	log.Info("Executing post-install commands")
-	for _, c := range l.Data.RunCMD {
-		c = append([]string{"-c"}, c...)
-		cmd := exec.Command("sh", c...)
-		cmd.Env = os.Environ()
-		log.Debugf("exec: sh -c \"%s\"", c[1:])
-		err := cmd.Run()
-		if err != nil {
-			log.Debugf("err: %s", err)
+// runs a command (see run), without handling its timeout
+func (l *Lift) runUntimed(cmd *exec.Cmd) error {
+	if l.dryRun {
+		entry := l.log.WithField("dir", cmd.Dir)
+		if env := envOverrides(cmd.Env); len(env) > 0 {
+			entry = entry.WithField("env", strings.Join(env, " "))
 		}
+		entry.Infof("dry-run: %s", strings.Join(cmd.Args, " "))
+		return nil
 	}
+	if cmd.Stderr != nil {
+		return l.executor.Run(cmd)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := l.executor.Run(cmd); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, msg)
+		}
+		return fmt.Errorf("%s: %w", strings.Join(cmd.Args, " "), err)
+	}
+	return nil
+}
 
-	// Final SSH restart because of added keys etc.
-	_ = doService("sshd", RESTART)
+// runs the command name with args (see run)
+func (l *Lift) runCmd(name string, args ...string) error {
+	return l.run(l.command(name, args...))
+}
 
-	// Delete the lift binary from the system
-	if l.Data.UnLift {
-		log.Info("Removing lift binary from the system")
-		binPath, err := os.Readlink("/proc/self/exe")
-		if err != nil {
-			return err
+// creates the groups from alpine-data
+func (l *Lift) groupsSetup() error {
+	for _, grp := range l.Data.Groups {
+		cmd := l.command("addgroup", grp)
+		l.log.Infof("Creating group %s", grp)
+		if err := l.run(cmd); err != nil {
+			l.log.Debugf("Error creating group %s: %v", grp, err)
 		}
-		log.WithField("path", binPath).Debug("os.Remove")
-		if err = os.Remove(binPath); err != nil {
+	}
+	return nil
+}
+
+// creates the users from alpine-data
+func (l *Lift) usersSetup() error {
+	for _, user := range l.Data.Users {
+		l.log.Infof("Creating user %s", user.Name)
+		if err := l.createOSUser(user); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// executes the bootcmd commands, before anything else is set up
+func (l *Lift) bootCommands() error {
+	return l.execCommands("bootcmd", l.Data.BootCMD)
+}
+
+// executes the runcmd commands and restarts sshd because of added keys etc.
+func (l *Lift) runCommands() error {
+	err := l.execCommands("runcmd", l.Data.RunCMD)
 
-	log.Info("Lift successfully completed")
+	// Final SSH restart because of added keys etc.
+	_ = l.doService("sshd", RESTART)
+	return err
+}
+
+// executes the commands of a section in order, stopping at the first one that
+// fails. A command given as a string runs through sh -c, a list is executed
+// as is.
+func (l *Lift) execCommands(section string, cmds []MultiString) error {
+	for _, c := range cmds {
+		if len(c) == 0 {
+			continue
+		}
+		var cmd *exec.Cmd
+		if len(c) == 1 {
+			cmd = l.command("sh", "-c", c[0])
+		} else {
+			cmd = l.command(c[0], c[1:]...)
+		}
+		cmd.Env = os.Environ()
+		// If not silenced, show the command output on stdout
+		if !l.silent {
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+		}
+		l.log.Debugf("exec: %s", strings.Join(cmd.Args, " "))
+		if err := l.run(cmd); err != nil {
+			return fmt.Errorf("%s %q failed: %w", section, strings.Join(c, " "), err)
+		}
+	}
 	return nil
 }
 
+// deletes the lift binary from the system
+func (l *Lift) unLift() error {
+	if !l.Data.UnLift {
+		return nil
+	}
+	binPath, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	l.log.WithField("path", binPath).Debug("os.Remove")
+	if l.dryRun {
+		return nil
+	}
+	return os.Remove(binPath)
+}
+
 // tries to get the alpine-data parameter from the kernel parameters in /proc/cmdline
 func getKernelBootParam(key string) (string, error) {
 	cmdline, err := ioutil.ReadFile("/proc/cmdline")
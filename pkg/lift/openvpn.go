@@ -0,0 +1,75 @@
+package lift
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const openvpnDir = "/etc/openvpn"
+
+// returns the password of the client, taken from the environment when
+// password_env is set
+func (c OVPNClient) password() string {
+	if c.PasswordEnv != "" {
+		return os.Getenv(c.PasswordEnv)
+	}
+	return c.Password
+}
+
+// installs openvpn and sets up an openvpn.<name> service for every client
+func (l *Lift) openvpnSetup() error {
+	if len(l.Data.OpenVPN) == 0 {
+		l.log.Debug("No OpenVPN clients configured")
+		return nil
+	}
+	if err := l.runCmd("apk", "add", "openvpn"); err != nil {
+		return err
+	}
+
+	for _, c := range l.Data.OpenVPN {
+		profile := []byte(c.Profile)
+		if c.ProfileURL != "" {
+			if l.skipOffline(c.ProfileURL, "OpenVPN client "+c.Name) {
+				continue
+			}
+			l.log.WithField("url", c.ProfileURL).Debugf("Downloading OpenVPN profile %s", c.Name)
+			var err error
+			if profile, err = l.downloadFile(c.ProfileURL, nil); err != nil {
+				return fmt.Errorf("unable to download OpenVPN profile %s: %w", c.Name, err)
+			}
+		}
+		if len(strings.TrimSpace(string(profile))) == 0 {
+			return fmt.Errorf("OpenVPN profile %s is empty", c.Name)
+		}
+
+		if c.Username != "" {
+			authFile := filepath.Join(openvpnDir, c.Name+".auth")
+			l.log.Debugf("Writing OpenVPN credentials to %s", authFile)
+			creds := fmt.Sprintf("%s\n%s\n", c.Username, c.password())
+			if err := l.writeFileAtomic(authFile, []byte(creds), 0600, ""); err != nil {
+				return err
+			}
+			profile = append(profile, []byte(fmt.Sprintf("\nauth-user-pass %s\n", authFile))...)
+		}
+		confFile := filepath.Join(openvpnDir, c.Name+".conf")
+		l.log.Debugf("Writing OpenVPN profile to %s", confFile)
+		if err := l.writeFileAtomic(confFile, profile, 0600, ""); err != nil {
+			return err
+		}
+
+		// openrc multi-instance service: openvpn.<name> uses <name>.conf
+		service := "openvpn." + c.Name
+		if err := l.runCmd("ln", "-sf", "/etc/init.d/openvpn", "/etc/init.d/"+service); err != nil {
+			return err
+		}
+		if err := l.doService(service, ENABLE, defaultRunlevel); err != nil {
+			return err
+		}
+		if err := l.doService(service, RESTART); err != nil {
+			return err
+		}
+	}
+	return nil
+}
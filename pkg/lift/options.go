@@ -0,0 +1,140 @@
+package lift
+
+import (
+	"fmt"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Option configures a Lift instance (see NewLift)
+type Option func(*Lift)
+
+// Executor runs the external commands lift needs for configuring the system
+type Executor interface {
+	Run(cmd *exec.Cmd) error
+}
+
+// default executor, simply runs the command
+type execExecutor struct{}
+
+func (execExecutor) Run(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+// WithSilent silences all logging and output of lift and the commands it runs
+func WithSilent(silent bool) Option {
+	return func(l *Lift) {
+		l.silent = silent
+	}
+}
+
+// SetSilent silences (or unsilences) all logging and output of lift
+func (l *Lift) SetSilent(silent bool) {
+	l.silent = silent
+}
+
+// Silent returns true when lift runs silenced
+func (l *Lift) Silent() bool {
+	return l.silent
+}
+
+// WithDryRun logs the external commands lift would run, instead of running them.
+// Files are written to a temporary directory instead of the system paths.
+func WithDryRun(dryRun bool) Option {
+	return func(l *Lift) {
+		l.dryRun = dryRun
+	}
+}
+
+// WithOffline disables all network downloads. Only file:// urls can be used
+// for alpine-data, write_files and authorized keys; stages that need to
+// download something else are skipped.
+func WithOffline(offline bool) Option {
+	return func(l *Lift) {
+		l.offline = offline
+	}
+}
+
+// WithExecutor replaces the executor used for running external commands
+func WithExecutor(e Executor) Option {
+	return func(l *Lift) {
+		l.executor = e
+	}
+}
+
+// WithLogger replaces the (logrus standard) logger lift logs to
+func WithLogger(logger *log.Logger) Option {
+	return func(l *Lift) {
+		l.log = logger
+	}
+}
+
+// WithStages limits lift to running only the named stages
+func WithStages(names ...string) Option {
+	return func(l *Lift) {
+		l.onlyStages = names
+	}
+}
+
+// WithSkipStages prevents lift from running the named stages
+func WithSkipStages(names ...string) Option {
+	return func(l *Lift) {
+		l.skipStages = names
+	}
+}
+
+// stages run in rescue mode: just enough to log in over SSH
+var rescueStages = []string{"network", "dns", "sshd"}
+
+// WithRescue limits lift to bringing up networking, DNS and sshd (including
+// the authorized keys), for getting into a half-broken system. Nothing
+// destructive is run.
+func WithRescue(rescue bool) Option {
+	return func(l *Lift) {
+		if rescue {
+			l.onlyStages = rescueStages
+		}
+	}
+}
+
+// StageNames returns the names of all stages, in the order they are executed
+func StageNames() []string {
+	var names []string
+	for _, s := range (&Lift{}).stages() {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// makes sure all selected/skipped stages actually exist
+func (l *Lift) validateStages() error {
+	known := make(map[string]bool)
+	for _, name := range StageNames() {
+		known[name] = true
+	}
+	for _, name := range append(append([]string{}, l.onlyStages...), l.skipStages...) {
+		if !known[name] {
+			return fmt.Errorf("unknown stage %q", name)
+		}
+	}
+	return nil
+}
+
+// returns true when the stage should be executed
+func (l *Lift) stageSelected(name string) bool {
+	for _, s := range l.skipStages {
+		if s == name {
+			return false
+		}
+	}
+	if len(l.onlyStages) == 0 {
+		return true
+	}
+	for _, s := range l.onlyStages {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
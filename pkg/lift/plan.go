@@ -0,0 +1,108 @@
+package lift
+
+import (
+	"os"
+)
+
+// StagePlan describes if a stage will be executed, and if not, why
+type StagePlan struct {
+	Name   string `json:"name"`
+	Run    bool   `json:"run"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Plan returns the stages in the order they are executed, and whether they
+// will run, without executing anything. It is based on the alpine-data as
+// currently loaded.
+func (l *Lift) Plan() []StagePlan {
+	var plan []StagePlan
+	for _, s := range l.stages() {
+		reason := l.skipReason(s.name)
+		plan = append(plan, StagePlan{Name: s.name, Run: reason == "", Reason: reason})
+	}
+	return plan
+}
+
+// returns why a stage will be skipped, or "" when it will run
+func (l *Lift) skipReason(name string) string {
+	for _, s := range l.skipStages {
+		if s == name {
+			return "in skip list"
+		}
+	}
+	if !l.stageSelected(name) {
+		return "not selected"
+	}
+
+	d, n := l.Data, l.Data.Network
+	var empty bool
+	switch name {
+	case "bootcmd":
+		empty = len(d.BootCMD) == 0
+	case "raid":
+		empty = len(d.RAID) == 0
+	case "lvm":
+		empty = d.LVM == nil
+	case "scratchdisk":
+		empty = d.ScratchDisk == ""
+	case "swap":
+		empty = !d.DisableSwap
+	case "disks":
+		empty = len(d.Disks) == 0
+	case "diskspace":
+		empty = d.MinFreeSpace <= 0
+	case "hostname":
+		empty = n == nil || (n.HostName == "" && len(n.HostEntries) == 0)
+	case "timezone":
+		empty = d.TimeZone == ""
+	case "network":
+		empty = n == nil
+	case "dns":
+		empty = n == nil || n.ResolvConf == nil || (!n.ResolvConf.Direct && len(n.ResolvConf.NameServers) == 0 && len(n.ResolvConf.SearchDomains) == 0 && len(n.ResolvConf.Options) == 0 && n.DNSDomain() == "")
+	case "proxy":
+		empty = n == nil || n.Proxy == ""
+	case "ntp":
+		empty = n == nil || n.NTP == nil || (len(n.NTP.Pools) == 0 && len(n.NTP.Servers) == 0)
+	case "apk":
+		empty = d.Packages == nil
+	case "setupscripts":
+		empty = len(d.SetupScripts) == 0
+	case "sshd":
+		empty = d.SSHDConfig == nil
+	case "firewall":
+		empty = d.Firewall == nil
+	case "fail2ban":
+		empty = d.Fail2Ban == nil || !d.Fail2Ban.Enable
+	case "openvpn":
+		empty = len(d.OpenVPN) == 0
+	case "groups":
+		empty = len(d.Groups) == 0
+	case "users":
+		empty = len(d.Users) == 0
+	case "drp":
+		empty = d.DRP == nil || !d.DRP.InstallRunner
+		if !empty && l.offline && !isLocalURL(d.DRP.AssetsURL) {
+			if _, err := os.Stat(drpcliBin); os.IsNotExist(err) {
+				return "offline mode"
+			}
+		}
+	case "mta":
+		empty = d.MTA == nil
+	case "files":
+		empty = len(d.WriteFiles) == 0
+	case "services":
+		empty = len(d.Services) == 0
+	case "console":
+		empty = d.Console == nil
+	case "motd":
+		empty = d.MOTD == ""
+	case "release":
+		empty = !d.WriteRelease
+	case "unlift":
+		empty = !d.UnLift
+	}
+	if empty {
+		return "not configured"
+	}
+	return ""
+}
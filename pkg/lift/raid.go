@@ -0,0 +1,50 @@
+package lift
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const mdadmConfFile = "/etc/mdadm.conf"
+
+// creates or assembles the RAID arrays, so the resulting md devices can be
+// used by the disk stages, and persists them in mdadm.conf
+func (l *Lift) raidSetup() error {
+	if len(l.Data.RAID) == 0 {
+		l.log.Debug("No RAID arrays configured")
+		return nil
+	}
+	if err := l.runCmd("apk", "add", "mdadm"); err != nil {
+		return err
+	}
+
+	for _, a := range l.Data.RAID {
+		args := []string{"--assemble", a.Device}
+		if !a.Assemble {
+			l.log.WithField("device", a.Device).Infof("Creating RAID%s array from %v", a.Level, a.Members)
+			args = []string{"--create", a.Device, "--run", "--level=" + a.Level,
+				fmt.Sprintf("--raid-devices=%d", len(a.Members))}
+		} else {
+			l.log.WithField("device", a.Device).Infof("Assembling RAID array from %v", a.Members)
+		}
+		if err := l.runCmd("mdadm", append(args, a.Members...)...); err != nil {
+			return fmt.Errorf("unable to set up RAID array %s: %v", a.Device, err)
+		}
+	}
+
+	var scan bytes.Buffer
+	cmd := l.command("mdadm", "--detail", "--scan")
+	cmd.Stdout = &scan
+	if err := l.run(cmd); err != nil {
+		return err
+	}
+	if scan.Len() == 0 {
+		l.log.Warnf("No RAID arrays found, not writing %s", mdadmConfFile)
+	} else {
+		l.log.Debugf("Writing %s", mdadmConfFile)
+		if err := l.writeFileAtomic(mdadmConfFile, scan.Bytes(), 0644, ""); err != nil {
+			return err
+		}
+	}
+	return l.doService("mdadm-raid", ENABLE, bootRunlevel)
+}
@@ -0,0 +1,125 @@
+package lift
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// orders the services in levels: every service only depends on services
+// in earlier levels, so the services within a level can be started
+// concurrently
+func serviceLevels(services []Service) ([][]Service, error) {
+	byName := make(map[string]Service)
+	for _, s := range services {
+		if _, dup := byName[s.Name]; dup {
+			return nil, fmt.Errorf("services: %s is listed more than once", s.Name)
+		}
+		byName[s.Name] = s
+	}
+	for _, s := range services {
+		for _, dep := range s.After {
+			if _, ok := byName[dep]; !ok {
+				return nil, fmt.Errorf("services: %s starts after %s, which is not in services", s.Name, dep)
+			}
+		}
+	}
+
+	var levels [][]Service
+	done := make(map[string]bool)
+	for len(done) < len(services) {
+		var level []Service
+		for _, s := range services {
+			if done[s.Name] {
+				continue
+			}
+			ready := true
+			for _, dep := range s.After {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				level = append(level, s)
+			}
+		}
+		if len(level) == 0 {
+			var cycle []string
+			for _, s := range services {
+				if !done[s.Name] {
+					cycle = append(cycle, s.Name)
+				}
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("services: dependency cycle between %s", strings.Join(cycle, ", "))
+		}
+		for _, s := range level {
+			done[s.Name] = true
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// brings the services in their desired state, concurrently where their
+// dependencies allow
+func (l *Lift) servicesSetup() error {
+	levels, err := serviceLevels(l.Data.Services)
+	if err != nil {
+		return err
+	}
+	for _, level := range levels {
+		var wg sync.WaitGroup
+		errs := make([]error, len(level))
+		for i, s := range level {
+			wg.Add(1)
+			go func(i int, s Service) {
+				defer wg.Done()
+				errs[i] = l.setupService(s)
+			}(i, s)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enables/disables the service in its runlevel and starts/stops it
+func (l *Lift) setupService(s Service) error {
+	script, ok := l.serviceScript(s.Name)
+	if !ok {
+		return fmt.Errorf("service %s doesn't exist (no rc script in %s)", s.Name, initDir)
+	}
+	states := s.states()
+	if states["enabled"] {
+		l.log.WithField("service", script).WithField("runlevel", s.runlevel()).Info("Enabling service")
+		if err := l.doService(s.Name, ENABLE, s.runlevel()); err != nil {
+			return fmt.Errorf("unable to enable service %s: %v", s.Name, err)
+		}
+	}
+	if states["disabled"] {
+		l.log.WithField("service", script).WithField("runlevel", s.runlevel()).Info("Disabling service")
+		if err := l.doService(s.Name, DISABLE, s.runlevel()); err != nil {
+			return fmt.Errorf("unable to disable service %s: %v", s.Name, err)
+		}
+	}
+	if states["started"] {
+		l.log.WithField("service", script).Info("Starting service")
+		if err := l.doService(s.Name, START); err != nil {
+			return fmt.Errorf("unable to start service %s: %v", s.Name, err)
+		}
+	}
+	if states["stopped"] {
+		l.log.WithField("service", script).Info("Stopping service")
+		if err := l.doService(s.Name, STOP); err != nil {
+			return fmt.Errorf("unable to stop service %s: %v", s.Name, err)
+		}
+	}
+	return nil
+}
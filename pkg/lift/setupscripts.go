@@ -0,0 +1,32 @@
+package lift
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runs the configured Alpine setup-<name> scripts, in order
+func (l *Lift) setupScriptsSetup() error {
+	for _, s := range l.Data.SetupScripts {
+		script := "setup-" + s.Name
+		if _, err := exec.LookPath(script); err != nil && !l.dryRun {
+			return fmt.Errorf("setup script %s not found", script)
+		}
+		l.log.WithField("script", script).Infof("Running %s %s", script, strings.Join(s.Args, " "))
+		cmd := l.command(script, s.Args...)
+		if s.Stdin != "" {
+			cmd.Stdin = strings.NewReader(s.Stdin)
+		}
+		// If not silenced, show the script output on stdout
+		if !l.silent {
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+		}
+		if err := l.run(cmd); err != nil {
+			return fmt.Errorf("%s failed: %w", script, err)
+		}
+	}
+	return nil
+}
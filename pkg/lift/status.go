@@ -0,0 +1,183 @@
+package lift
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const releaseFile = "/etc/alpine-lift-release"
+
+// Status reports the progress and outcome of a lift
+type Status struct {
+	Started    time.Time     `json:"started"`
+	Current    string        `json:"current,omitempty"`
+	Finished   *time.Time    `json:"finished,omitempty"`
+	DurationMS int64         `json:"duration_ms"`
+	Stages     []StageStatus `json:"stages"`
+	Error      string        `json:"error,omitempty"`
+	Build      *BuildInfo    `json:"build,omitempty"`
+}
+
+// BuildInfo identifies the lift release (set through ldflags at build time)
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// StageStatus reports the outcome of a single stage
+type StageStatus struct {
+	Name       string        `json:"name"`
+	Skipped    bool          `json:"skipped,omitempty"`
+	DurationMS int64         `json:"duration_ms"`
+	Error      string        `json:"error,omitempty"`
+	Category   ErrorCategory `json:"category,omitempty"`
+}
+
+// WithStatusFile makes lift write its status (as JSON) to path after every stage
+func WithStatusFile(path string) Option {
+	return func(l *Lift) {
+		l.statusFile = path
+	}
+}
+
+// WithMetricsURL makes lift POST its final status (as JSON) to url
+func WithMetricsURL(url string) Option {
+	return func(l *Lift) {
+		l.metricsURL = url
+	}
+}
+
+// WithBuildInfo makes lift report the release it was built from
+func WithBuildInfo(b BuildInfo) Option {
+	return func(l *Lift) {
+		l.build = &b
+	}
+}
+
+// WithStatusServer makes lift serve its status (as JSON) over HTTP on addr
+// (host:port) while it runs
+func WithStatusServer(addr string) Option {
+	return func(l *Lift) {
+		l.statusAddr = addr
+	}
+}
+
+// Status returns the status of the (running or finished) lift
+func (l *Lift) Status() Status {
+	l.statusMu.Lock()
+	defer l.statusMu.Unlock()
+	return l.status
+}
+
+// marks the stage as running
+func (l *Lift) startStage(name string) {
+	l.statusMu.Lock()
+	l.status.Current = name
+	l.statusMu.Unlock()
+}
+
+// starts serving the status over HTTP. The returned function stops the server.
+func (l *Lift) serveStatus() (stop func(), err error) {
+	ln, err := net.Listen("tcp", l.statusAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serve status on %s: %v", l.statusAddr, err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(l.Status())
+	})}
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	l.log.WithField("addr", ln.Addr().String()).Info("Serving status")
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}, nil
+}
+
+// records the outcome of a stage, logs its timing and updates the status file
+func (l *Lift) recordStage(name string, skipped bool, d time.Duration, err error) {
+	s := StageStatus{
+		Name:       name,
+		Skipped:    skipped,
+		DurationMS: d.Milliseconds(),
+	}
+	if err != nil {
+		s.Error = err.Error()
+		s.Category = categorize(err)
+	}
+	l.statusMu.Lock()
+	l.status.Current = ""
+	l.status.Stages = append(l.status.Stages, s)
+	l.statusMu.Unlock()
+	if !skipped {
+		l.log.WithField("stage", name).WithField("duration_ms", s.DurationMS).Info("Stage finished")
+	}
+	l.writeStatus()
+}
+
+// finalizes the status when lift is done, and reports it
+func (l *Lift) finishStatus(err error) {
+	now := time.Now()
+	l.statusMu.Lock()
+	l.status.Current = ""
+	l.status.Finished = &now
+	l.status.DurationMS = now.Sub(l.status.Started).Milliseconds()
+	if err != nil {
+		l.status.Error = err.Error()
+	}
+	l.statusMu.Unlock()
+	l.writeStatus()
+
+	if l.metricsURL != "" && !l.skipOffline(l.metricsURL, "posting metrics") {
+		l.log.WithField("url", l.metricsURL).Debug("Posting metrics")
+		// not bound to l.ctx: the metrics are also posted after an interrupt
+		_, timeout := l.downloadLimits()
+		if err := postJSON(l.metricsURL, l.Status(), timeout); err != nil {
+			l.log.Warnf("Error posting metrics: %v", err)
+		}
+	}
+}
+
+// writes the release file, recording which lift release provisioned the system
+func (l *Lift) writeRelease() error {
+	if !l.Data.WriteRelease {
+		return nil
+	}
+	b := BuildInfo{Version: "unknown"}
+	if l.build != nil {
+		b = *l.build
+	}
+	data := fmt.Sprintf("VERSION=%q\nCOMMIT=%q\nBUILD_DATE=%q\nPROVISIONED=%q\n",
+		b.Version, b.Commit, b.BuildDate, l.status.Started.UTC().Format(time.RFC3339))
+	l.log.Debugf("Writing %s", releaseFile)
+	return l.writeFileAtomic(releaseFile, []byte(data), 0644, "")
+}
+
+// writes the status to the status file, if one was configured
+func (l *Lift) writeStatus() {
+	if l.statusFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(l.Status(), "", "  ")
+	if err != nil {
+		l.log.Warnf("Error encoding status: %v", err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(l.statusFile), 0755); err == nil {
+		err = ioutil.WriteFile(l.statusFile, data, 0644)
+	}
+	if err != nil {
+		l.log.Warnf("Error writing status file %s: %v", l.statusFile, err)
+	}
+}
@@ -1,7 +1,12 @@
 package lift
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
 	"strings"
 	"text/template"
 
@@ -14,7 +19,7 @@ const (
 	HOSTNAMEOPTS="-n {{ index $h 0 }}"
 	INTERFACESOPTS="{{ .Network.InterfaceOpts }}"
 	DNSOPTS="-d {{ .Network.ResolvConf.Domain }} {{range .Network.ResolvConf.NameServers}}{{.}}{{end}}"
-	TIMEZONEOPTS="-z {{ .TimeZone }}"
+	TIMEZONEOPTS="-z {{ or .TimeZone "UTC" }}"
 	PROXYOPTS="{{ .Network.Proxy }}"
 	APKREPOSOPTS="-1"
 	SSHDOPTS="-c openssh"
@@ -75,7 +80,9 @@ const (
 		eend 0
 	}`
 
-	repositoriesTemplate = "{{ range . }}{{ . }}\n{{ end }}"
+	repositoriesTemplate = `{{ range .Packages.Repositories }}{{ if .Tag }}@{{ .Tag }} {{ end }}{{ .URL }}
+{{ end }}{{ range .Packages.UnreachableRepositories }}# unreachable: {{ . }}
+{{ end }}`
 
 	chronyTemplate = `{{ if .Network.NTP.Pools }}
 {{ range .Network.NTP.Pools }}
@@ -85,13 +92,199 @@ initstepslew 10 {{ index .Network.NTP.Pools 0 }}
 {{ end }}
 {{ if .Network.NTP.Servers }}
 {{ range .Network.NTP.Servers }}
-server {{.}} iburst maxsources 3
+server {{ .Address }} {{ .ChronyOptions }}
 {{ end }}
-initstepslew 10 {{ index .Network.NTP.Servers 0 }}
+initstepslew 10 {{ (index .Network.NTP.Servers 0).Address }}
 {{ end }}
 driftfile /var/lib/chrony/chrony.drift
+makestep {{ or .Network.NTP.MakeStep "1.0 3" }}
 rtcsync`
 
+	// legacy (busybox) ifupdown
+	interfacesTemplate = `{{ range $i := .Network.AllInterfaces -}}
+auto {{ .Name }}
+iface {{ .Name }} {{ if and (eq $.Network.IPv6Mode "only") (eq .InetMethod "static") }}inet6{{ else }}inet{{ end }} {{ .InetMethod }}
+{{- if eq .InetMethod "dhcp" }}
+	hostname {{ index (split $.Network.HostName ".") 0 }}
+{{- end }}
+{{- with .BondSlaves }}
+	bond-slaves {{ join . " " }}
+{{- end }}
+{{- with .BondMode }}
+	bond-mode {{ . }}
+{{- end }}
+{{- with .VLANRawDevice }}
+	vlan-raw-device {{ . }}
+{{- end }}
+{{- with .CIDRAddress }}
+	address {{ . }}
+{{- end }}
+{{- if and .Gateway (not $.Network.Isolated) }}
+	gateway {{ .Gateway }}
+{{- end }}
+{{- with .MTU }}
+	mtu {{ . }}
+{{- end }}
+{{- range .Routes }}
+	post-up ip route add {{ .IPRoute }}
+{{- end }}
+{{- if $.Resolvconf }}
+{{- with .DNSNameServers }}
+	dns-nameservers {{ join . " " }}
+{{- end }}
+{{- with .DNSSearch }}
+	dns-search {{ join . " " }}
+{{- end }}
+{{- end }}
+{{- with .IPv6Method }}
+
+iface {{ $i.Name }} inet6 {{ . }}
+{{- if eq . "static" }}
+	address {{ $i.IPv6Address }}
+{{- if and $i.IPv6Gateway (not $.Network.Isolated) }}
+	gateway {{ $i.IPv6Gateway }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{ end }}`
+
+	// ifupdown-ng: the method is selected with executors (use lines)
+	interfacesNGTemplate = `{{ range $i := .Network.AllInterfaces -}}
+auto {{ .Name }}
+iface {{ .Name }}
+{{- if and (ne .InetMethod "static") (ne .InetMethod "manual") }}
+	use {{ .InetMethod }}
+{{- end }}
+{{- with .BondSlaves }}
+	use bond
+	bond-members {{ join . " " }}
+{{- end }}
+{{- with .BondMode }}
+	bond-mode {{ . }}
+{{- end }}
+{{- with .VLANRawDevice }}
+	vlan-raw-device {{ . }}
+	vlan-id {{ $i.VLANID }}
+{{- end }}
+{{- if and (eq .IPv6Method "dhcp") (ne .InetMethod "dhcp") }}
+	use dhcp
+{{- end }}
+{{- range .Use }}
+	use {{ . }}
+{{- end }}
+{{- with .CIDRAddress }}
+	address {{ . }}
+{{- end }}
+{{- if eq .IPv6Method "static" }}
+	address {{ .IPv6Address }}
+{{- end }}
+{{- if and .Gateway (not $.Network.Isolated) }}
+	gateway {{ .Gateway }}
+{{- end }}
+{{- if and (eq .IPv6Method "static") .IPv6Gateway (not $.Network.Isolated) }}
+	gateway {{ .IPv6Gateway }}
+{{- end }}
+{{- with .MTU }}
+	mtu {{ . }}
+{{- end }}
+{{- range .Routes }}
+	post-up ip route add {{ .IPRoute }}
+{{- end }}
+{{- if $.Resolvconf }}
+{{- with .DNSNameServers }}
+	dns-nameservers {{ join . " " }}
+{{- end }}
+{{- with .DNSSearch }}
+	dns-search {{ join . " " }}
+{{- end }}
+{{- end }}
+
+{{ end }}`
+
+	resolvConfTemplate = `{{ with .Network.ResolvConf -}}
+{{ with $.Network.DNSDomain }}domain {{ . }}
+{{ end -}}
+{{ if .SearchDomains }}search {{ join .SearchDomains " " }}
+{{ else if $.Network.DNSDomain }}search {{ $.Network.DNSDomain }}
+{{ end -}}
+{{ range .NameServers }}nameserver {{ . }}
+{{ end -}}
+{{ if .Options }}options {{ join .Options " " }}
+{{ end -}}
+{{ end }}`
+
+	ntpdTemplate = `NTPD_OPTS="-N{{ range .Network.NTP.Pools }} -p {{.}}{{ end }}{{ range .Network.NTP.Servers }} -p {{ .Address }}{{ end }}"
+`
+
+	openntpdTemplate = `{{ range .Network.NTP.Pools }}servers {{.}}
+{{ end }}{{ range .Network.NTP.Servers }}server {{ .Address }}
+{{ end }}`
+
+	iptablesTemplate = `*filter
+:INPUT DROP [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p icmp -j ACCEPT
+{{ range .Firewall.Rules }}{{ if ne (ipfamily .Source) "ip6" -}}
+-A INPUT -p {{ .Protocol }}{{ if .Source }} -s {{ .Source }}{{ end }} --dport {{ .Port }} -j ACCEPT
+{{ end }}{{ end -}}
+COMMIT
+`
+
+	ip6tablesTemplate = `*filter
+:INPUT DROP [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p ipv6-icmp -j ACCEPT
+{{ range .Firewall.Rules }}{{ if ne (ipfamily .Source) "ip" -}}
+-A INPUT -p {{ .Protocol }}{{ if .Source }} -s {{ .Source }}{{ end }} --dport {{ .Port }} -j ACCEPT
+{{ end }}{{ end -}}
+COMMIT
+`
+
+	nftablesTemplate = `#!/usr/sbin/nft -f
+flush ruleset
+
+table inet filter {
+	chain input {
+		type filter hook input priority 0; policy drop;
+		ct state established,related accept
+		iif lo accept
+		ip protocol icmp accept
+		ip6 nexthdr icmpv6 accept
+{{- range .Firewall.Rules }}
+		{{ if .Source }}{{ ipfamily .Source }} saddr {{ .Source }} {{ end }}{{ .Protocol }} dport {{ .Port }} accept
+{{- end }}
+	}
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+	}
+	chain output {
+		type filter hook output priority 0; policy accept;
+	}
+}
+`
+
+	fail2banTemplate = `[DEFAULT]
+banaction = {{ .Fail2BanAction }}
+{{ with .Fail2Ban }}{{ if .BanTime }}bantime = {{ .BanTime }}
+{{ end }}{{ if .FindTime }}findtime = {{ .FindTime }}
+{{ end }}{{ if .MaxRetry }}maxretry = {{ .MaxRetry }}
+{{ end }}{{ end }}
+{{- range .Fail2BanJails }}
+[{{ .Name }}]
+enabled = true
+{{ if .Port }}port = {{ .Port }}
+{{ end }}{{ if .Filter }}filter = {{ .Filter }}
+{{ end }}{{ if .LogPath }}logpath = {{ .LogPath }}
+{{ end }}{{ if .MaxRetry }}maxretry = {{ .MaxRetry }}
+{{ end }}{{ end }}`
+
 	ssmtpTemplate = `hostname={{ .Network.HostName }}
 {{ if .MTA.Root }}root={{ .MTA.Root }}{{ end }}
 {{ if .MTA.Server }}mailhub={{ .MTA.Server }}{{ end }}
@@ -102,49 +295,195 @@ rtcsync`
 {{ if .MTA.AuthMethod }}AuthMethod={{ upper .MTA.AuthMethod }}{{ end }}
 {{ if .MTA.RewriteDomain }}rewriteDomain={{ .MTA.RewriteDomain }}{{ end }}
 {{ if .MTA.FromLineOverride }}FromLineOverride=Yes{{ end }}
+`
+
+	msmtprcTemplate = `defaults
+syslog LOG_MAIL
+tls_trust_file /etc/ssl/certs/ca-certificates.crt
+{{ if .MTA.Root }}aliases /etc/msmtp-aliases
+{{ end }}
+account default
+host {{ .MTA.Host }}
+{{ with .MTA.Port }}port {{ . }}
+{{ end -}}
+{{ if or .MTA.UseTLS .MTA.UseSTARTTLS }}tls on
+tls_starttls {{ if .MTA.UseSTARTTLS }}on{{ else }}off{{ end }}
+{{ end -}}
+{{ if .MTA.User }}auth {{ .MTA.MSMTPAuth }}
+user {{ .MTA.User }}
+password {{ .MTA.Password }}
+{{ end -}}
+{{ if .MTA.RootAlias }}from {{ .MTA.RootAlias }}
+{{ else if .MTA.RewriteDomain }}auto_from on
+maildomain {{ .MTA.RewriteDomain }}
+{{ end -}}
+{{ if .MTA.FromLineOverride }}allow_from_override on
+{{ end -}}
+`
+
+	// msmtp doesn't know root=, mail for root and the other local users goes to it
+	msmtpAliasesTemplate = `root: {{ .MTA.Root }}
+default: {{ .MTA.Root }}
+`
+
+	revaliasesTemplate = `root:{{ .MTA.RootAlias }}{{ with .MTA.Server }}:{{ . }}{{ end }}
 `
 )
 
 var (
-	tplFuncMap                                              = make(template.FuncMap)
-	answerFile, drpcliInit, repoFile, chronyConf, ssmtpConf *template.Template
+	tplFuncMap                                                             = make(template.FuncMap)
+	answerFile, drpcliInit, repoFile, chronyConf, ssmtpConf, resolvConf    *template.Template
+	ntpdConf, openntpdConfig, iptablesRules, ip6tablesRules, nftablesRules *template.Template
+	fail2banJail, interfaces, interfacesNG, revaliases                     *template.Template
+	msmtprc, msmtpAliases                                                  *template.Template
 )
 
 func init() {
 	// Initialise parser functions
 	tplFuncMap["split"] = Split
 	tplFuncMap["upper"] = Upper
+	tplFuncMap["join"] = Join
+	tplFuncMap["ipfamily"] = IPFamily
 	answerFile = template.Must(template.New("answerfile").Funcs(tplFuncMap).Parse(answerFileTemplate))
 	drpcliInit = template.Must(template.New("drpcli").Funcs(tplFuncMap).Parse(drpcliServiceTemplate))
 	repoFile = template.Must(template.New("repositories").Funcs(tplFuncMap).Parse(repositoriesTemplate))
 	chronyConf = template.Must(template.New("chrony").Funcs(tplFuncMap).Parse(chronyTemplate))
 	ssmtpConf = template.Must(template.New("ssmtp").Funcs(tplFuncMap).Parse(ssmtpTemplate))
+	revaliases = template.Must(template.New("revaliases").Funcs(tplFuncMap).Parse(revaliasesTemplate))
+	msmtprc = template.Must(template.New("msmtprc").Funcs(tplFuncMap).Parse(msmtprcTemplate))
+	msmtpAliases = template.Must(template.New("msmtp-aliases").Funcs(tplFuncMap).Parse(msmtpAliasesTemplate))
+	ntpdConf = template.Must(template.New("ntpd").Funcs(tplFuncMap).Parse(ntpdTemplate))
+	openntpdConfig = template.Must(template.New("openntpd").Funcs(tplFuncMap).Parse(openntpdTemplate))
+	iptablesRules = template.Must(template.New("iptables").Funcs(tplFuncMap).Parse(iptablesTemplate))
+	ip6tablesRules = template.Must(template.New("ip6tables").Funcs(tplFuncMap).Parse(ip6tablesTemplate))
+	nftablesRules = template.Must(template.New("nftables").Funcs(tplFuncMap).Parse(nftablesTemplate))
+	fail2banJail = template.Must(template.New("fail2ban").Funcs(tplFuncMap).Parse(fail2banTemplate))
+	resolvConf = template.Must(template.New("resolv.conf").Funcs(tplFuncMap).Parse(resolvConfTemplate))
+	interfaces = template.Must(template.New("interfaces").Funcs(tplFuncMap).Parse(interfacesTemplate))
+	interfacesNG = template.Must(template.New("interfaces-ng").Funcs(tplFuncMap).Parse(interfacesNGTemplate))
+}
+
+// TemplateContext is the data all templates are rendered against. It embeds
+// the alpine-data, so all of its fields are available (e.g. {{ .Network.HostName }}),
+// together with facts about the running system.
+type TemplateContext struct {
+	*AlpineData
+	Hostname      string // current hostname of the system
+	Interface     string // name of the first non-loopback interface that is up
+	IPv4          string // first global IPv4 address of Interface
+	IPv6          string // first global IPv6 address of Interface
+	KernelVersion string // running kernel release (uname -r)
+	Resolvconf    bool   // resolvconf is installed (e.g. openresolv)
 }
 
-// This function takes a template and data struct, executes (parses) the template
-// and stores the result in a temporary file. Then it returns the path to the
-// generated file or an error if there was one. So this is basically a wrapper
-// for template.Execute, but using a file.
-func generateFileFromTemplate(t template.Template, data interface{}) (string, error) {
-	// generate temporary file
-	tmpfile, err := ioutil.TempFile("", "lift-*")
+// collects the current system facts into a template context
+func (l *Lift) templateContext() *TemplateContext {
+	ctx := &TemplateContext{AlpineData: l.Data}
+	if _, err := exec.LookPath("resolvconf"); err == nil {
+		ctx.Resolvconf = true
+	}
+	ctx.Hostname, _ = os.Hostname()
+	if release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		ctx.KernelVersion = strings.TrimSpace(string(release))
+	}
+
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		return "", err
+		return ctx
 	}
-	defer tmpfile.Close()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ctx.Interface = iface.Name
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				if ctx.IPv4 == "" {
+					ctx.IPv4 = ipnet.IP.String()
+				}
+			} else if ctx.IPv6 == "" {
+				ctx.IPv6 = ipnet.IP.String()
+			}
+		}
+		break
+	}
+	return ctx
+}
 
-	// execute the template, saving the result in the tempfile
-	if err := t.Execute(tmpfile, data); err != nil {
-		return "", err
+// Renders the template against the template context and atomically
+// writes the result to path.
+func (l *Lift) installTemplate(t template.Template, path string, perm os.FileMode) error {
+	data, err := l.renderTemplate(t)
+	if err != nil {
+		return err
 	}
 
-	log.WithFields(log.Fields{
+	l.log.WithFields(log.Fields{
 		"template": t.Name(),
-		"file":     tmpfile.Name(),
+		"file":     path,
 	}).Debug("parsed template to file")
 
-	// return handle to the temp file
-	return tmpfile.Name(), nil
+	return l.writeFileAtomic(path, data, perm, "")
+}
+
+// Executes (parses) the template against the template context, and
+// returns the result.
+func (l *Lift) renderTemplate(t template.Template) ([]byte, error) {
+	if o, ok := l.Data.Templates[t.Name()]; ok {
+		override, err := o.parse(t.Name())
+		if err != nil {
+			return nil, err
+		}
+		l.log.WithField("template", t.Name()).Debug("Using template override")
+		t = *override
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, l.templateContext()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// returns the names of the built-in templates, which can be overridden
+func templateNames() []string {
+	var names []string
+	for _, t := range []*template.Template{answerFile, drpcliInit, repoFile, chronyConf, ssmtpConf,
+		resolvConf, ntpdConf, openntpdConfig, iptablesRules, ip6tablesRules, nftablesRules,
+		fail2banJail, interfaces, interfacesNG, revaliases, msmtprc, msmtpAliases} {
+		names = append(names, t.Name())
+	}
+	return names
+}
+
+// parses the override of the named template, from its file or inline content
+func (o TemplateOverride) parse(name string) (*template.Template, error) {
+	text := o.Content
+	if o.Path != "" {
+		data, err := ioutil.ReadFile(o.Path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s template override: %v", name, err)
+		}
+		text = string(data)
+	}
+	t, err := template.New(name).Funcs(tplFuncMap).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template override: %v", name, err)
+	}
+	return t, nil
+}
+
+// parses the content of a write_files entry (at path) as a template
+func parseContentTemplate(path, content string) (*template.Template, error) {
+	t, err := template.New(path).Funcs(tplFuncMap).Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for %s: %v", path, err)
+	}
+	return t, nil
 }
 
 // Split is a parser function that can be used from inside the template
@@ -156,3 +495,20 @@ func Split(s string, d string) []string {
 func Upper(s string) string {
 	return strings.ToUpper(s)
 }
+
+// Join is a parser function that can be used from inside the template
+func Join(s []string, sep string) string {
+	return strings.Join(s, sep)
+}
+
+// IPFamily is a parser function that returns the nftables address family
+// ("ip" or "ip6") of an address or CIDR, or "" for no address (any)
+func IPFamily(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	if strings.Contains(addr, ":") {
+		return "ip6"
+	}
+	return "ip"
+}
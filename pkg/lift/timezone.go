@@ -0,0 +1,53 @@
+package lift
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	zoneInfoDir   = "/usr/share/zoneinfo"
+	localTimeFile = "/etc/localtime"
+	timezoneFile  = "/etc/timezone"
+)
+
+// sets the system timezone, installing tzdata when needed
+func (l *Lift) timezoneSetup() error {
+	tz := l.Data.TimeZone
+	if tz == "" {
+		return nil
+	}
+	zoneFile := filepath.Join(zoneInfoDir, tz)
+	// without tzdata (and /etc/localtime), musl uses UTC
+	utc := tz == "UTC" && !fileExists(zoneFile)
+	if !utc {
+		l.log.Debug("apk add tzdata")
+		if err := l.runCmd("apk", "add", "tzdata"); err != nil {
+			return err
+		}
+		if fi, err := os.Stat(zoneFile); !l.dryRun && (err != nil || fi.IsDir()) {
+			return fmt.Errorf("unknown timezone %q", tz)
+		}
+	}
+	l.log.WithField("timezone", tz).Debugf("Linking %s", localTimeFile)
+	localTime, err := l.target(localTimeFile)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(localTime); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !utc {
+		if err := os.Symlink(zoneFile, localTime); err != nil {
+			return err
+		}
+	}
+	return l.writeFileAtomic(timezoneFile, []byte(tz+"\n"), 0644, "")
+}
+
+// returns true when path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
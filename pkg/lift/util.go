@@ -2,25 +2,68 @@ package lift
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+)
+
+const initDir = "/etc/init.d"
+
+// rc script names of services that differ across Alpine releases
+var serviceNames = map[string][]string{
+	"chronyd": {"chronyd", "chrony"},
+}
 
-	log "github.com/sirupsen/logrus"
+// ServiceAction is something doService can do with an openrc service
+type ServiceAction int
+
+// Constants for service actions
+const (
+	START ServiceAction = iota
+	RESTART
+	STOP
+	RELOAD
+	ZAP
+	ENABLE
+	DISABLE
 )
 
-// Constants for service states
+// openrc runlevels services are enabled in
 const (
-	START   = "start"
-	RESTART = "restart"
-	STOP    = "stop"
-	RELOAD  = "reload"
-	ZAP     = "zap"
+	sysinitRunlevel  = "sysinit"
+	bootRunlevel     = "boot"
+	defaultRunlevel  = "default"
+	shutdownRunlevel = "shutdown"
 )
 
+func (a ServiceAction) String() string {
+	switch a {
+	case START:
+		return "start"
+	case RESTART:
+		return "restart"
+	case STOP:
+		return "stop"
+	case RELOAD:
+		return "reload"
+	case ZAP:
+		return "zap"
+	case ENABLE:
+		return "enable"
+	case DISABLE:
+		return "disable"
+	}
+	return fmt.Sprintf("ServiceAction(%d)", int(a))
+}
+
 // rewrites a config file with values from alpine-data
 func parseConfigFile(path, sep string, kv map[string]string) error {
 	conf, err := ioutil.ReadFile(path)
@@ -35,6 +78,104 @@ func parseConfigFile(path, sep string, kv map[string]string) error {
 	return nil
 }
 
+// removes all entries with an IPv6 address (e.g. ::1) from a hosts file
+func removeIPv6Hosts(path string) error {
+	hosts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var out []string
+	for _, line := range strings.Split(string(hosts), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && strings.Contains(fields[0], ":") && !strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(out, "\n")), 0644)
+}
+
+// removes the names from the hosts file lines for ip, unless the line has
+// canonical as its (first) canonical name. Lines left without names are removed.
+func removeHostsNames(path, ip, canonical string, names ...string) error {
+	hosts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	drop := make(map[string]bool)
+	for _, name := range names {
+		drop[name] = true
+	}
+	var out []string
+	for _, line := range strings.Split(string(hosts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != ip || fields[1] == canonical {
+			out = append(out, line)
+			continue
+		}
+		kept := fields[:1]
+		for _, name := range fields[1:] {
+			if !drop[name] {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) == len(fields) {
+			out = append(out, line)
+		} else if len(kept) > 1 {
+			out = append(out, kept[0]+"\t"+strings.Join(kept[1:], " "))
+		}
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(out, "\n")), 0644)
+}
+
+// replaces the resolv.conf line(s) for keyword (e.g. search) with a single
+// line, or appends it when there is none
+func setResolvConfLine(path, keyword string, values []string) error {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	set := keyword + " " + strings.Join(values, " ")
+	var out []string
+	done := false
+	for _, line := range strings.Split(strings.TrimRight(string(conf), "\n"), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == keyword {
+			if done {
+				continue
+			}
+			line, done = set, true
+		}
+		out = append(out, line)
+	}
+	if !done {
+		out = append(out, set)
+	}
+	return ioutil.WriteFile(path, []byte(strings.TrimLeft(strings.Join(out, "\n"), "\n")+"\n"), 0644)
+}
+
+// appends the lines that are not yet in the config file (uncommented)
+func addConfigLines(path string, add []string) error {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(conf), "\n"), "\n")
+	present := make(map[string]bool)
+	for _, line := range lines {
+		present[strings.TrimSpace(line)] = true
+	}
+	for _, line := range add {
+		if !present[line] {
+			lines = append(lines, line)
+			present[line] = true
+		}
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
 // Terribly inefficient way to find keys and replace them with
 // our own value... Refactor at a later point in time...
 // sep defines the separator (typically " ", ":" or "=")
@@ -57,6 +198,355 @@ func findReplace(conf []byte, sep string, kv map[string]string) []byte {
 	return []byte(out)
 }
 
+// rewrites the fstab entry for mountpoint. The update function receives the
+// fields of the entry, and may change them in place.
+func updateFstabEntry(path, mountpoint string, update func(fields []string)) error {
+	fstab, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	found := false
+	lines := strings.Split(string(fstab), "\n")
+	for i, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") || fields[1] != mountpoint {
+			continue
+		}
+		update(fields)
+		lines[i] = strings.Join(fields, "\t")
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no entry for %s found in %s", mountpoint, path)
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// removes all swap entries from fstab
+func removeFstabSwap(path string) error {
+	fstab, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, l := range strings.Split(string(fstab), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) >= 3 && !strings.HasPrefix(fields[0], "#") && fields[2] == "swap" {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// returns the names of the interfaces configured for DHCP (IPv4) in an
+// /etc/network/interfaces file, in either ifupdown or ifupdown-ng dialect
+func dhcpInterfaces(path string) ([]string, error) {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	iface := ""
+	for _, l := range strings.Split(string(conf), "\n") {
+		fields := strings.Fields(l)
+		switch {
+		case len(fields) >= 2 && fields[0] == "iface":
+			iface = fields[1]
+			if len(fields) >= 4 && fields[2] == "inet" && fields[3] == "dhcp" {
+				names = append(names, iface)
+			}
+		case len(fields) == 2 && fields[0] == "use" && fields[1] == "dhcp" && iface != "":
+			names = append(names, iface)
+		}
+	}
+	return names, nil
+}
+
+// returns true when the interface has a (non link-local) IPv4 address
+func hasIPv4Address(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// key types allowed in authorized_keys files
+var sshKeyTypes = []string{
+	"ssh-rsa", "ssh-dss", "ssh-ed25519",
+	"ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521",
+	"sk-ssh-ed25519@openssh.com", "sk-ecdsa-sha2-nistp256@openssh.com",
+}
+
+// checks if line looks like an authorized_keys entry: optional options,
+// followed by a known key type and a base64 encoded key
+func isSSHPublicKey(line string) bool {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		for _, t := range sshKeyTypes {
+			if f == t && i+1 < len(fields) {
+				_, err := base64.StdEncoding.DecodeString(fields[i+1])
+				return err == nil
+			}
+		}
+	}
+	return false
+}
+
+// writes data to a temporary file next to path and renames it into place,
+// so path either has the old or the new content, never something halfway.
+// Mode and (when set) owner are applied before the rename.
+func (l *Lift) writeFileAtomic(path string, data []byte, perm os.FileMode, owner string) error {
+	path, err := l.target(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), fmt.Sprintf(".%s.lift-*", filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	// nothing left to remove once renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if owner != "" {
+		if err = l.runCmd("chown", owner, tmp.Name()); err != nil {
+			return fmt.Errorf("unable to change owner of %s to %s: %v", path, owner, err)
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// appends data to the file at path, unless the file already contains it (so
+// running lift again doesn't append it twice). A new file is created with
+// perm and owner, the permissions of an existing file are left alone.
+func (l *Lift) appendFile(path string, data []byte, perm os.FileMode, owner string) error {
+	path, err := l.target(path)
+	if err != nil {
+		return err
+	}
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	created := os.IsNotExist(err)
+	if len(data) == 0 || bytes.Contains(existing, data) {
+		l.log.Debugf("%s already contains the content", path)
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		data = append([]byte("\n"), data...)
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if !created {
+		return nil
+	}
+	// the umask applies to OpenFile
+	if err = os.Chmod(path, perm); err != nil {
+		return err
+	}
+	if owner != "" {
+		if err = l.runCmd("chown", owner, path); err != nil {
+			return fmt.Errorf("unable to change owner of %s to %s: %v", path, owner, err)
+		}
+	}
+	return nil
+}
+
+// creates dir and its missing parents with perm. The directories that are
+// created (not the existing ones) are owned by owner, when given.
+func (l *Lift) mkdirs(dir string, perm os.FileMode, owner string) error {
+	dir, err := l.target(dir)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || d == filepath.Dir(d) {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err = os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		// the umask applies to MkdirAll
+		if err = os.Chmod(d, perm); err != nil {
+			return err
+		}
+		if owner != "" {
+			if err = l.runCmd("chown", owner, d); err != nil {
+				return fmt.Errorf("unable to change owner of %s to %s: %v", d, owner, err)
+			}
+		}
+	}
+	return nil
+}
+
+// returns the path to write to. In dry-run mode that is a copy of path in the
+// dry-run directory, so the system files are left untouched while the
+// generated files can still be inspected.
+func (l *Lift) target(path string) (string, error) {
+	if !l.dryRun {
+		return path, nil
+	}
+	if l.dryRunDir == "" {
+		dir, err := ioutil.TempDir("", "lift-dry-run-")
+		if err != nil {
+			return "", err
+		}
+		l.dryRunDir = dir
+		l.log.WithField("dir", dir).Info("dry-run: writing files to the dry-run directory")
+	}
+	t := filepath.Join(l.dryRunDir, path)
+	if _, err := os.Lstat(t); err == nil {
+		return t, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(t), 0755); err != nil {
+		return "", err
+	}
+	// start from the current contents, for files that are edited
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err = ioutil.WriteFile(t, data, 0644); err != nil {
+			return "", err
+		}
+	}
+	l.log.WithField("path", t).Debugf("dry-run: using a copy of %s", path)
+	return t, nil
+}
+
+// returns the environment variables set for a command, that differ from
+// the environment of lift
+func envOverrides(env []string) []string {
+	current := make(map[string]bool)
+	for _, e := range os.Environ() {
+		current[e] = true
+	}
+	var overrides []string
+	for _, e := range env {
+		if !current[e] {
+			overrides = append(overrides, e)
+		}
+	}
+	return overrides
+}
+
+// opens or creates an authorized_keys file for appending. The .ssh directory
+// it lives in gets mode 0700, and both are owned by the owner of the home
+// directory. Don't forget to close the file!!
+func openAuthorizedKeys(path string) (*os.File, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := openOrCreate(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, err
+	}
+	fi, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		for _, p := range []string{dir, path} {
+			if err := os.Chown(p, int(st.Uid), int(st.Gid)); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+	}
+	return file, nil
+}
+
+// appends the keys that aren't in the authorized_keys file yet, so re-runs
+// don't add duplicates
+func appendAuthorizedKeys(path string, keys []string) error {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	present := make(map[string]bool)
+	for _, line := range strings.Split(string(existing), "\n") {
+		present[strings.TrimSpace(line)] = true
+	}
+	file, err := openAuthorizedKeys(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		if _, err = file.WriteString("\n"); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || present[key] {
+			continue
+		}
+		present[key] = true
+		if _, err = file.WriteString(key + "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the home directory of the (existing) user. When it can't be looked
+// up (e.g. in dry-run mode, where the user isn't created), the configured
+// homedir or /home/<name> is used.
+func userHomeDir(u User) string {
+	if usr, err := user.Lookup(u.Name); err == nil && usr.HomeDir != "" {
+		return usr.HomeDir
+	}
+	if u.HomeDir != "" {
+		return u.HomeDir
+	}
+	return filepath.Join("/home", u.Name)
+}
+
 // this function takes a path to a file, and tries to
 // open it, creating it if it doesn't exist.
 // Don't forget to close the file!!
@@ -87,17 +577,71 @@ func openOrCreate(path string) (*os.File, error) {
 	return file, nil
 }
 
-// interact with openrc to start, stop, restart or reload a service
-func doService(name string, action string) error {
-	cmd := exec.Command("service", name, action)
-	err := cmd.Run()
-	return err
+// returns true when the (query) command succeeds. In dry-run mode nothing
+// is assumed to exist.
+func (l *Lift) exists(name string, args ...string) bool {
+	return !l.dryRun && l.runCmd(name, args...) == nil
+}
+
+// interact with openrc to start, stop, restart or reload a service, or to
+// enable/disable it in a runlevel (rc-update add/del). Without a runlevel
+// rc-update uses the current one.
+func (l *Lift) doService(name string, action ServiceAction, runlevel ...string) error {
+	if len(runlevel) > 1 || (len(runlevel) == 1 && action != ENABLE && action != DISABLE) {
+		return fmt.Errorf("service %s %s: unexpected runlevel %v", name, action, runlevel)
+	}
+	script, ok := l.serviceScript(name)
+	if !ok {
+		l.log.Warnf("No rc script found for service %s (tried %s in %s)", name, strings.Join(serviceCandidates(name), ", "), initDir)
+		return fmt.Errorf("service %s not installed", name)
+	}
+	var out bytes.Buffer
+	var cmd *exec.Cmd
+	switch action {
+	case ENABLE:
+		cmd = l.command("rc-update", append([]string{"add", script}, runlevel...)...)
+	case DISABLE:
+		cmd = l.command("rc-update", append([]string{"del", script}, runlevel...)...)
+	default:
+		cmd = l.command("service", script, action.String())
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := l.run(cmd); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("service %s %s failed: %w: %s", script, action, err, msg)
+		}
+		return fmt.Errorf("service %s %s failed: %w", script, action, err)
+	}
+	return nil
+}
+
+// returns the rc scripts that may provide a (logical) service
+func serviceCandidates(name string) []string {
+	if candidates, ok := serviceNames[name]; ok {
+		return candidates
+	}
+	return []string{name}
+}
+
+// resolves a logical service name to the rc script present in /etc/init.d.
+// In dry-run mode the first candidate is used.
+func (l *Lift) serviceScript(name string) (string, bool) {
+	candidates := serviceCandidates(name)
+	if l.dryRun {
+		return candidates[0], true
+	}
+	for _, c := range candidates {
+		if _, err := os.Stat(filepath.Join(initDir, c)); err == nil {
+			return c, true
+		}
+	}
+	return "", false
 }
 
 // Creates an OS user
-func createOSUser(u User) error {
-	args := []string{u.Name}
-	var input []byte
+func (l *Lift) createOSUser(u User) error {
+	args := []string{"-D", u.Name}
 
 	if u.NoCreateHomeDir {
 		args = append([]string{"-H"}, args...)
@@ -113,56 +657,87 @@ func createOSUser(u User) error {
 	if u.System {
 		args = append([]string{"-S"}, args...)
 	}
-	if u.Password != "" {
-		input = []byte(fmt.Sprintf("%s\n%s\n", u.Password, u.Password))
-	} else {
-		args = append([]string{"-D"}, args...)
-	}
 	if u.Shell != "" {
 		args = append([]string{"-s", u.Shell}, args...)
 	}
 
-	cmd := exec.Command("adduser", args...)
-	if len(input) > 0 {
-		cmd.Stdin = bytes.NewBuffer(input)
+	// the user may already exist when lift is run again
+	if l.exists("id", u.Name) {
+		l.log.Debugf("User %s already exists", u.Name)
+	} else {
+		if err := l.runCmd("adduser", args...); err != nil {
+			return fmt.Errorf("unable to create user %s: %v", u.Name, err)
+		}
 	}
-	err := cmd.Run()
-	if err != nil {
-		log.Debugf("Error creating user %s: %s", u.Name, err)
+
+	// set for existing users too, like the root password
+	if u.Password != "" {
+		cmd := l.command("chpasswd")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("%s:%s\n", u.Name, u.Password))
+		if err := l.run(cmd); err != nil {
+			return fmt.Errorf("unable to set password of %s: %v", u.Name, err)
+		}
 	}
 
-	if u.Groups != nil && len(u.Groups) > 0 {
-		for _, g := range u.Groups {
-			cmd := exec.Command("adduser", u.Name, g)
-			err = cmd.Run()
-			if err != nil {
-				log.Debugf("Error adding %s to %s: %s", u.Name, g, err)
-			}
+	for _, g := range u.Groups {
+		if err := l.runCmd("adduser", u.Name, g); err != nil {
+			return fmt.Errorf("unable to add %s to group %s: %v", u.Name, g, err)
 		}
 	}
 
 	if u.SSHAuthorizedKeys != nil && len(u.SSHAuthorizedKeys) > 0 {
-		cmd := exec.Command("grep", u.Name, "/etc/passwd")
-		var b bytes.Buffer
-		cmd.Stdout = &b
-		_ = cmd.Run()
-		homeDir := strings.Split(b.String(), ":")[5]
-		sshDir := fmt.Sprintf("%s/.ssh", homeDir)
-		authKeysFile := fmt.Sprintf("%s/authorized_keys", sshDir)
-		file, err := openOrCreate(authKeysFile)
+		authKeysFile := filepath.Join(userHomeDir(u), ".ssh", "authorized_keys")
+		path, err := l.target(authKeysFile)
 		if err != nil {
-			log.Debugf("Error while opening %s: %v", authKeysFile, err)
+			return err
 		}
-		defer file.Close()
-		_, err = file.WriteString(fmt.Sprintln(strings.Join(u.SSHAuthorizedKeys, "\n")))
-		if err != nil {
-			log.Debugf("Error writing keys in %s: %v", authKeysFile, err)
+		if err = appendAuthorizedKeys(path, u.SSHAuthorizedKeys); err != nil {
+			return fmt.Errorf("unable to write keys to %s: %v", authKeysFile, err)
+		}
+	}
+
+	if u.PasswordHash != "" {
+		cmd := l.command("chpasswd", "-e")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("%s:%s\n", u.Name, u.PasswordHash))
+		if err := l.run(cmd); err != nil {
+			return fmt.Errorf("unable to set password of %s: %v", u.Name, err)
+		}
+	}
+
+	if u.Expiry != "" || u.PasswordMaxDays > 0 {
+		if err := l.setPasswordAging(u); err != nil {
+			return err
+		}
+	}
+
+	// finally unlock, unless the account should stay locked
+	if u.Locked {
+		if err := l.runCmd("passwd", "-l", u.Name); err != nil {
+			return fmt.Errorf("unable to lock password of %s: %v", u.Name, err)
 		}
+		return nil
 	}
+	cmd := l.command("passwd", "-u", u.Name)
+	_ = l.run(cmd)
 
-	// finally unlock
-	cmd = exec.Command("passwd", "-u", u.Name)
-	_ = cmd.Run()
+	return nil
+}
 
+// sets the account expiry date and maximum password age of an existing user
+func (l *Lift) setPasswordAging(u User) error {
+	// chage is not part of busybox
+	if err := l.runCmd("apk", "add", "shadow"); err != nil {
+		return err
+	}
+	var args []string
+	if u.Expiry != "" {
+		args = append(args, "-E", u.Expiry)
+	}
+	if u.PasswordMaxDays > 0 {
+		args = append(args, "-M", strconv.Itoa(u.PasswordMaxDays))
+	}
+	if err := l.runCmd("chage", append(args, u.Name)...); err != nil {
+		return fmt.Errorf("unable to set password aging of %s: %v", u.Name, err)
+	}
 	return nil
 }
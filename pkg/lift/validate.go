@@ -0,0 +1,536 @@
+package lift
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Validate checks the alpine-data for invalid or conflicting settings,
+// before anything on the system is touched
+func (d *AlpineData) Validate() error {
+	if d.RootPasswdLock && d.RootPasswd != "" {
+		return errors.New("password and lock_password are mutually exclusive")
+	}
+	if d.RootPasswdHashed && !isCryptHash(d.RootPasswd) {
+		return errors.New("password_hashed requires password to be a crypt hash (e.g. $6$...)")
+	}
+	if d.DRP != nil && d.DRP.DRPCLISHA256 != "" && !isSHA256(d.DRP.DRPCLISHA256) {
+		return errors.New("dr_provision: drpcli_sha256 must be 64 hexadecimal characters")
+	}
+	if d.Download != nil && (d.Download.Retries < 0 || d.Download.RetryDelay < 0) {
+		return errors.New("download: retries and retry_delay can't be negative")
+	}
+	for _, a := range d.RAID {
+		if err := a.validate(); err != nil {
+			return err
+		}
+	}
+	if d.LVM != nil {
+		if err := d.LVM.validate(); err != nil {
+			return err
+		}
+	}
+	for _, u := range d.Users {
+		if err := u.validate(); err != nil {
+			return err
+		}
+	}
+	for _, wf := range d.WriteFiles {
+		if err := wf.validate(); err != nil {
+			return err
+		}
+	}
+	if d.Packages != nil {
+		for _, repo := range d.Packages.Repositories {
+			if repo.URL == "" || strings.ContainsAny(repo.URL, " \t") {
+				return fmt.Errorf("packages: invalid repository %q", repo)
+			}
+			if strings.ContainsAny(repo.Tag, "@ \t") {
+				return fmt.Errorf("packages: invalid repository tag %q", repo.Tag)
+			}
+			if _, err := template.New("repository").Parse(repo.URL); err != nil {
+				return fmt.Errorf("packages: invalid repository %q: %v", repo, err)
+			}
+		}
+		for _, p := range d.Packages.Install {
+			if err := p.validate(d.Packages.Repositories); err != nil {
+				return err
+			}
+		}
+		for _, pattern := range d.Packages.UpgradeExclude {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("packages: invalid upgrade_exclude pattern %q", pattern)
+			}
+		}
+	}
+	if d.Packages != nil && d.Packages.CacheDir != "" && !filepath.IsAbs(d.Packages.CacheDir) {
+		return fmt.Errorf("packages: cache_dir %q must be an absolute path", d.Packages.CacheDir)
+	}
+	if d.MTA != nil {
+		switch d.MTA.MTAProvider() {
+		case "ssmtp", "msmtp":
+		default:
+			return fmt.Errorf("mta: unknown provider %q (ssmtp or msmtp)", d.MTA.Provider)
+		}
+		if d.MTA.Password != "" && d.MTA.User == "" {
+			return errors.New("mta: password requires a user")
+		}
+		if d.MTA.AuthMethod != "" && d.MTA.User == "" {
+			return errors.New("mta: authmethod requires a user")
+		}
+	}
+	if d.MTA != nil && d.MTA.TestRecipient != "" {
+		if _, err := mail.ParseAddress(d.MTA.TestRecipient); err != nil {
+			return fmt.Errorf("mta: invalid test_recipient %q: %v", d.MTA.TestRecipient, err)
+		}
+	}
+	if d.MTA != nil && d.MTA.RootAlias != "" {
+		if _, err := mail.ParseAddress(d.MTA.RootAlias); err != nil {
+			return fmt.Errorf("mta: invalid root_alias %q: %v", d.MTA.RootAlias, err)
+		}
+	}
+	for _, c := range d.OpenVPN {
+		if c.Name == "" || strings.ContainsAny(c.Name, "/. ") {
+			return fmt.Errorf("openvpn: invalid client name %q", c.Name)
+		}
+		if (c.Profile == "") == (c.ProfileURL == "") {
+			return fmt.Errorf("openvpn: client %s needs either a profile or a profile_url", c.Name)
+		}
+	}
+	if d.SSHDConfig != nil {
+		types := make(map[string]bool)
+		for _, k := range d.SSHDConfig.HostKeys {
+			if err := k.validate(); err != nil {
+				return err
+			}
+			if types[k.Type] {
+				return fmt.Errorf("sshd: duplicate %s host key", k.Type)
+			}
+			types[k.Type] = true
+		}
+	}
+	for _, s := range d.SetupScripts {
+		if s.Name == "" || strings.ContainsAny(s.Name, "/ ") || strings.HasPrefix(s.Name, "setup-") {
+			return fmt.Errorf("setup_scripts: invalid name %q (e.g. xorg-base for setup-xorg-base)", s.Name)
+		}
+	}
+	if d.Console != nil {
+		if err := d.Console.validate(); err != nil {
+			return err
+		}
+	}
+	for _, s := range d.Services {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := serviceLevels(d.Services); err != nil {
+		return err
+	}
+	if len(d.Templates) > 0 {
+		known := make(map[string]bool)
+		for _, name := range templateNames() {
+			known[name] = true
+		}
+		for name, o := range d.Templates {
+			if !known[name] {
+				return fmt.Errorf("templates: unknown template %q", name)
+			}
+			if (o.Path == "") == (o.Content == "") {
+				return fmt.Errorf("templates: %s needs either a path or content", name)
+			}
+			if o.Content != "" {
+				if _, err := o.parse(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(d.StageHooks) > 0 || len(d.CommandTimeouts) > 0 {
+		known := make(map[string]bool)
+		for _, name := range StageNames() {
+			known[name] = true
+		}
+		for name := range d.StageHooks {
+			if !known[name] {
+				return fmt.Errorf("stage_hooks: unknown stage %q", name)
+			}
+		}
+		for name, t := range d.CommandTimeouts {
+			if !known[name] {
+				return fmt.Errorf("command_timeouts: unknown stage %q", name)
+			}
+			if t < 0 {
+				return fmt.Errorf("command_timeouts: timeout of %s can't be negative", name)
+			}
+		}
+	}
+	if d.CommandTimeout < 0 {
+		return errors.New("command_timeout can't be negative")
+	}
+	if d.TimeZone != "" && (filepath.IsAbs(d.TimeZone) || strings.Contains(d.TimeZone, "..")) {
+		return fmt.Errorf("unknown timezone %q", d.TimeZone)
+	}
+	if d.MinFreeSpace < 0 {
+		return errors.New("min_free_space can't be negative")
+	}
+	if err := d.validateScratchDisk(); err != nil {
+		return err
+	}
+	if d.Firewall != nil {
+		if err := d.Firewall.validate(); err != nil {
+			return err
+		}
+	}
+	if d.Fail2Ban != nil {
+		for _, j := range d.Fail2Ban.Jails {
+			if j.Name == "" {
+				return errors.New("fail2ban: every jail needs a name")
+			}
+		}
+	}
+	if d.Network != nil && d.Network.HostName != "" {
+		if err := validateHostname(d.Network.HostName); err != nil {
+			return err
+		}
+	}
+	if d.Network != nil && d.Network.ResolvConf != nil {
+		for _, o := range d.Network.ResolvConf.Options {
+			if strings.TrimSpace(o) == "" || strings.ContainsAny(o, " \t\n") {
+				return fmt.Errorf("network: invalid resolv_conf option %q", o)
+			}
+		}
+	}
+	if d.Network != nil {
+		for _, e := range d.Network.HostEntries {
+			if net.ParseIP(e.IP) == nil {
+				return fmt.Errorf("network: invalid ip %q in hosts", e.IP)
+			}
+			if len(e.Hostnames) == 0 {
+				return fmt.Errorf("network: hosts entry %s needs hostnames", e.IP)
+			}
+			for _, name := range e.Hostnames {
+				if err := validateHostname(name); err != nil {
+					return err
+				}
+			}
+		}
+		if err := d.Network.validateInterfaces(); err != nil {
+			return err
+		}
+		if err := d.Network.validateBonds(); err != nil {
+			return err
+		}
+		if err := d.Network.validateVLANs(); err != nil {
+			return err
+		}
+		if err := d.Network.validateRoutes(); err != nil {
+			return err
+		}
+	}
+	if d.Network != nil && d.Network.NTP != nil {
+		if err := d.Network.NTP.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *NetworkSettings) validateBonds() error {
+	declared := make(map[string]bool)
+	for _, i := range n.Interfaces {
+		declared[i.Name] = true
+	}
+	for _, b := range n.Bonds {
+		if b.Name == "" || len(b.Slaves) == 0 {
+			return errors.New("network: every bond needs a name and slaves")
+		}
+		if declared[b.Name] {
+			return fmt.Errorf("network: bond %s is also in interface_config", b.Name)
+		}
+		declared[b.Name] = true
+		for _, s := range b.Slaves {
+			if declared[s] {
+				return fmt.Errorf("network: slave %s of bond %s is configured elsewhere", s, b.Name)
+			}
+			declared[s] = true
+		}
+	}
+	return nil
+}
+
+func (n *NetworkSettings) validateVLANs() error {
+	declared := make(map[string]bool)
+	for _, i := range n.AllInterfaces() {
+		if i.VLANRawDevice == "" {
+			declared[i.Name] = true
+		}
+	}
+	for _, v := range n.VLANs {
+		if v.VLANID < 1 || v.VLANID > 4094 {
+			return fmt.Errorf("network: vlan %s needs an id between 1 and 4094", v.VLANName())
+		}
+		if v.ParentInterface == "" {
+			return fmt.Errorf("network: vlan %s needs a parent interface", v.VLANName())
+		}
+		if !declared[v.ParentInterface] {
+			return fmt.Errorf("network: parent interface %s of vlan %s isn't declared in interface_config or bonds", v.ParentInterface, v.VLANName())
+		}
+		if declared[v.VLANName()] {
+			return fmt.Errorf("network: vlan %s is configured more than once", v.VLANName())
+		}
+		declared[v.VLANName()] = true
+	}
+	return nil
+}
+
+func (n *NetworkSettings) validateRoutes() error {
+	all := n.AllInterfaces()
+	if len(n.Routes) > 0 && len(all) == 0 {
+		return errors.New("network: routes require interface_config")
+	}
+	declared := make(map[string]bool)
+	routed := make(map[Route]bool)
+	for _, i := range all {
+		declared[i.Name] = true
+		for _, r := range i.Routes {
+			routed[r] = true
+		}
+	}
+	for _, r := range n.Routes {
+		if _, _, err := net.ParseCIDR(r.Destination); err != nil {
+			return fmt.Errorf("network: route destination %q is not in CIDR notation", r.Destination)
+		}
+		if r.Gateway != "" && net.ParseIP(r.Gateway) == nil {
+			return fmt.Errorf("network: invalid gateway %q for route %s", r.Gateway, r.Destination)
+		}
+		if r.Gateway == "" && r.Interface == "" {
+			return fmt.Errorf("network: route %s needs a gateway or an interface", r.Destination)
+		}
+		if r.Interface != "" && !declared[r.Interface] {
+			return fmt.Errorf("network: interface %s of route %s isn't declared", r.Interface, r.Destination)
+		}
+		if !routed[r] {
+			return fmt.Errorf("network: gateway %s of route %s isn't in the subnet of a static interface, set the route interface", r.Gateway, r.Destination)
+		}
+	}
+	return nil
+}
+
+func (n *NetworkSettings) validateInterfaces() error {
+	switch n.IPv6Mode() {
+	case "auto", "disable", "only":
+	default:
+		return fmt.Errorf("network: unknown ipv6 mode %q (auto, disable or only)", n.IPv6)
+	}
+	for _, i := range n.AllInterfaces() {
+		if i.Name == "" {
+			return errors.New("network: every interface needs a name")
+		}
+		if i.MTU != 0 && (i.MTU < 68 || i.MTU > 65535) {
+			return fmt.Errorf("network: invalid mtu %d for interface %s (68-65535)", i.MTU, i.Name)
+		}
+		for _, ns := range i.DNSNameServers {
+			if net.ParseIP(ns) == nil {
+				return fmt.Errorf("network: invalid dns nameserver %q for interface %s", ns, i.Name)
+			}
+		}
+		switch i.InetMethod() {
+		case "dhcp", "loopback", "manual":
+		case "static":
+			if _, _, err := net.ParseCIDR(i.CIDRAddress()); err != nil {
+				return fmt.Errorf("network: static interface %s needs an address in CIDR notation, or an address and netmask", i.Name)
+			}
+		default:
+			return fmt.Errorf("network: unknown method %q for interface %s (dhcp, static, manual or loopback)", i.Method, i.Name)
+		}
+		switch i.IPv6Method() {
+		case "":
+		case "static":
+			if ip, _, err := net.ParseCIDR(i.IPv6Address); err != nil || ip.To4() != nil {
+				return fmt.Errorf("network: interface %s needs an ipv6_address in CIDR notation for ipv6_mode static", i.Name)
+			}
+			if i.IPv6Gateway != "" {
+				if ip := net.ParseIP(i.IPv6Gateway); ip == nil || ip.To4() != nil {
+					return fmt.Errorf("network: invalid ipv6_gateway %q for interface %s", i.IPv6Gateway, i.Name)
+				}
+			}
+		case "dhcp", "auto":
+			if i.IPv6Address != "" || i.IPv6Gateway != "" {
+				return fmt.Errorf("network: ipv6_address and ipv6_gateway of interface %s are only used with ipv6_mode static", i.Name)
+			}
+		default:
+			return fmt.Errorf("network: unknown ipv6_mode %q for interface %s (static, dhcp or auto)", i.IPv6Mode, i.Name)
+		}
+		if i.IPv6Method() != "" && n.IPv6Mode() == "disable" {
+			return fmt.Errorf("network: interface %s has ipv6_mode set, but ipv6 is disabled", i.Name)
+		}
+		if i.InetMethod() == "loopback" || i.InetMethod() == "manual" {
+			continue
+		}
+		ip, _, _ := net.ParseCIDR(i.CIDRAddress())
+		switch n.IPv6Mode() {
+		case "only":
+			if ip == nil || ip.To4() != nil {
+				return fmt.Errorf("network: ipv6 only requires interface %s to be static, with an IPv6 address", i.Name)
+			}
+		case "disable":
+			if ip != nil && ip.To4() == nil {
+				return fmt.Errorf("network: interface %s has an IPv6 address, but ipv6 is disabled", i.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// options supported with the chrony server directive
+var chronyServerOptions = map[string]bool{
+	"prefer": true, "iburst": true, "burst": true, "noselect": true, "trust": true,
+	"require": true, "minpoll": true, "maxpoll": true, "maxsources": true,
+	"minstratum": true, "polltarget": true, "offline": true, "auto_offline": true,
+}
+
+// returns true when s is a crypt(3) hash with an algorithm id ($id$...)
+func isCryptHash(s string) bool {
+	parts := strings.Split(s, "$")
+	return len(parts) >= 4 && parts[0] == "" && parts[1] != "" && parts[len(parts)-1] != ""
+}
+
+func (n *NTPConfiguration) validate() error {
+	if n.DisableDefaults && len(n.Pools) == 0 && len(n.Servers) == 0 {
+		return errors.New("ntp: disable_defaults requires at least one pool or server")
+	}
+	impl, err := ntpImplementationFor(n.Implementation)
+	if err != nil {
+		return err
+	}
+	for _, s := range n.Servers {
+		if s.Address == "" {
+			return errors.New("ntp: every server needs an address")
+		}
+		if len(s.Options) > 0 && impl.service != "chronyd" {
+			return fmt.Errorf("ntp: options of server %s are only supported with chrony", s.Address)
+		}
+		for _, o := range s.Options {
+			if f := strings.Fields(o); len(f) == 0 || !chronyServerOptions[f[0]] {
+				return fmt.Errorf("ntp: unknown option %q for server %s", o, s.Address)
+			}
+		}
+	}
+	if n.HWClockWrite && impl.service != "chronyd" {
+		return errors.New("ntp: hwclock_write is only supported with chrony")
+	}
+	if n.WaitForSync && impl.service != "chronyd" {
+		return errors.New("ntp: wait_for_sync is only supported with chrony")
+	}
+	if n.MakeStep != "" && len(strings.Fields(n.MakeStep)) != 2 {
+		return fmt.Errorf("ntp: invalid makestep %q (e.g. \"1.0 3\")", n.MakeStep)
+	}
+	return nil
+}
+
+func (a RAIDArray) validate() error {
+	if a.Device == "" || len(a.Members) == 0 {
+		return errors.New("raid: every array needs a device and members")
+	}
+	if !a.Assemble {
+		if a.Level == "" {
+			return fmt.Errorf("raid: %s needs a level to be created", a.Device)
+		}
+		if !a.Force {
+			return fmt.Errorf("raid: creating %s wipes %s, set force to confirm (or assemble)", a.Device, strings.Join(a.Members, ", "))
+		}
+	}
+	return nil
+}
+
+func (u User) validate() error {
+	if u.Password != "" && u.PasswordHash != "" {
+		return fmt.Errorf("users: passwd and hashed_passwd of %s are mutually exclusive", u.Name)
+	}
+	if u.Expiry != "" {
+		if _, err := time.Parse("2006-01-02", u.Expiry); err != nil {
+			return fmt.Errorf("users: invalid expiredate %q of %s (YYYY-MM-DD)", u.Expiry, u.Name)
+		}
+	}
+	if u.PasswordMaxDays < 0 {
+		return fmt.Errorf("users: invalid password_max_days %d of %s", u.PasswordMaxDays, u.Name)
+	}
+	return nil
+}
+
+func (v *LVMConfig) validate() error {
+	if v.VolumeGroup == "" || len(v.PhysicalVolumes) == 0 {
+		return errors.New("lvm: volume_group and physical_volumes are required")
+	}
+	for _, lv := range v.LogicalVolumes {
+		if lv.Name == "" || lv.Size == "" {
+			return errors.New("lvm: every logical volume needs a name and a size")
+		}
+	}
+	return nil
+}
+
+func (d *AlpineData) validateScratchDisk() error {
+	switch d.scratchDiskMode() {
+	case "data":
+	case "sys", "boot":
+		if d.ScratchDiskMountPoint != "" || d.ScratchDiskMountOpts != "" {
+			return errors.New("scratch_disk_mountpoint and scratch_disk_mount_opts are only valid with scratch_disk_mode data")
+		}
+	default:
+		return fmt.Errorf("unknown scratch_disk_mode %q (data, sys or boot)", d.ScratchDiskMode)
+	}
+	if d.ScratchDiskMountPoint != "" && !filepath.IsAbs(d.ScratchDiskMountPoint) {
+		return fmt.Errorf("scratch_disk_mountpoint %q must be an absolute path", d.ScratchDiskMountPoint)
+	}
+	return nil
+}
+
+func (f *FirewallConfig) validate() error {
+	if b := strings.ToLower(f.Backend); b != "" && b != "iptables" && b != "nftables" {
+		return fmt.Errorf("firewall: unknown backend %q (iptables or nftables)", f.Backend)
+	}
+	for _, r := range f.Rules {
+		if r.Port < 1 || r.Port > 65535 {
+			return fmt.Errorf("firewall: invalid port %d", r.Port)
+		}
+		if p := r.Protocol(); p != "tcp" && p != "udp" {
+			return fmt.Errorf("firewall: invalid protocol %q for port %d (tcp or udp)", r.Proto, r.Port)
+		}
+		if r.Source != "" && net.ParseIP(r.Source) == nil {
+			if _, _, err := net.ParseCIDR(r.Source); err != nil {
+				return fmt.Errorf("firewall: invalid source %q for port %d", r.Source, r.Port)
+			}
+		}
+	}
+	return nil
+}
+
+// checks the hostname against RFC 1123
+func validateHostname(name string) error {
+	if len(name) > 253 {
+		return fmt.Errorf("invalid hostname %q: longer than 253 characters", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) < 1 || len(label) > 63 {
+			return fmt.Errorf("invalid hostname %q: labels must be 1 to 63 characters", name)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid hostname %q: labels can't start or end with a hyphen", name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid hostname %q: invalid character %q", name, c)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package lift
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const runlevelsDir = "/etc/runlevels"
+
+// Verify checks the system against the alpine-data, without changing
+// anything. It returns the discrepancies found.
+func (l *Lift) Verify() ([]string, error) {
+	if l.fetchData {
+		if err := l.fetchAlpineData(); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.Data.Validate(); err != nil {
+		return nil, err
+	}
+
+	var found []string
+	report := func(format string, args ...interface{}) {
+		found = append(found, fmt.Sprintf(format, args...))
+	}
+	d := l.Data
+
+	if d.Network != nil && d.Network.HostName != "" {
+		want := strings.Split(d.Network.HostName, ".")[0]
+		if host, _ := os.Hostname(); host != want {
+			report("hostname is %q, expected %q", host, want)
+		}
+	}
+
+	if d.Packages != nil {
+		for _, p := range d.Packages.Install {
+			if !packageInstalled(p.Name) {
+				report("package %s is not installed", p.Name)
+			}
+		}
+		for _, p := range d.Packages.Uninstall {
+			if packageInstalled(p) {
+				report("package %s is installed, expected it to be removed", p)
+			}
+		}
+	}
+
+	for _, svc := range l.expectedServices() {
+		if !serviceEnabled(svc) {
+			report("service %s is not enabled", svc)
+		}
+	}
+
+	for _, wf := range d.WriteFiles {
+		fi, err := os.Stat(wf.Path)
+		if err != nil {
+			report("file %s is missing", wf.Path)
+			continue
+		}
+		if perm, err := wf.mode(); err == nil && fi.Mode().Perm() != perm.Perm() {
+			report("file %s has mode %04o, expected %04o", wf.Path, fi.Mode().Perm(), perm.Perm())
+		}
+	}
+
+	if d.SSHDConfig != nil && len(d.SSHDConfig.AuthorizedKeys) > 0 {
+		path := d.SSHDConfig.authorizedKeysPath()
+		keys, _ := ioutil.ReadFile(path)
+		for _, key := range d.SSHDConfig.AuthorizedKeys {
+			if !strings.Contains(string(keys), key) {
+				report("authorized key %.40s... is missing from %s", key, path)
+			}
+		}
+	}
+
+	if d.MOTD != "" {
+		if motd, err := ioutil.ReadFile("/etc/motd"); err != nil || strings.TrimSpace(string(motd)) != strings.TrimSpace(d.MOTD) {
+			report("/etc/motd doesn't contain the configured motd")
+		}
+	}
+	return found, nil
+}
+
+// returns the services the alpine-data should have enabled
+func (l *Lift) expectedServices() []string {
+	d := l.Data
+	var services []string
+	if d.Network != nil && d.Network.NTP != nil && (len(d.Network.NTP.Pools) > 0 || len(d.Network.NTP.Servers) > 0) {
+		if impl, err := ntpImplementationFor(d.Network.NTP.Implementation); err == nil {
+			services = append(services, impl.service)
+		}
+	}
+	if d.Firewall != nil {
+		services = append(services, d.Firewall.backend())
+	}
+	if d.Fail2Ban != nil && d.Fail2Ban.Enable {
+		services = append(services, "fail2ban")
+	}
+	for _, c := range d.OpenVPN {
+		services = append(services, "openvpn."+c.Name)
+	}
+	if d.DRP != nil && d.DRP.InstallRunner {
+		services = append(services, "drpcli")
+	}
+	for _, s := range d.Services {
+		if s.states()["enabled"] {
+			services = append(services, s.Name)
+		}
+	}
+	return services
+}
+
+// returns true when the apk package is installed
+func packageInstalled(name string) bool {
+	return exec.Command("apk", "info", "-e", name).Run() == nil
+}
+
+// returns true when the service (or one of its rc script names) is added
+// to any runlevel
+func serviceEnabled(name string) bool {
+	for _, script := range serviceCandidates(name) {
+		if matches, _ := filepath.Glob(filepath.Join(runlevelsDir, "*", script)); len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}